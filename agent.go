@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/interceptor"
+	"github.com/auh-xda/magnesia/scheduler"
+	"github.com/auh-xda/magnesia/sink"
+	"github.com/auh-xda/magnesia/updater"
+)
+
+const (
+	defaultInterval  = 5 * time.Minute
+	maxDefaultJitter = 5 * time.Minute
+)
+
+// Run keeps the agent resident, running every collector on its own schedule
+// until the service manager asks it to stop.
+func (magnesia Magnesia) Run() {
+	cfg, err := config.ParseConfig()
+
+	if err != nil {
+		console.Error("Error parsing config: " + err.Error())
+		return
+	}
+
+	jobs := magnesia.jobs(cfg)
+
+	// the updater rolls back unless this binary delivers an envelope within
+	// the grace period, so after an update start with a full intercept
+	// snapshot instead of waiting for jitter and deltas
+	if updater.Verifying(version) {
+		console.Info("Verifying update to " + version + ", publishing a full snapshot")
+
+		if err := sink.ResetState(); err != nil {
+			console.Error(err.Error())
+		}
+
+		for i := range jobs {
+			if jobs[i].Name == "intercept" {
+				jobs[i].Jitter = 0
+			}
+		}
+	}
+
+	// nothing has been published since install, so send the first
+	// inventory now rather than after the jitter
+	if _, err := os.Stat(config.Sequence()); os.IsNotExist(err) {
+		console.Info("First run, publishing every collector now")
+
+		for i := range jobs {
+			jobs[i].Jitter = 0
+		}
+	}
+
+	var healthy sync.Once
+	sink.OnDelivered(func() {
+		healthy.Do(func() { updater.ReportHealthy(version) })
+	})
+
+	serve(func(ctx context.Context) {
+		console.Info("Magnesia agent running")
+
+		watchReload(ctx, reload)
+		magnesia.listen(cfg)
+
+		scheduler.Start(ctx, jobs)
+
+		console.Warn("Magnesia agent stopped")
+	})
+}
+
+// reload resolves the configuration again. Sinks are rebuilt, and the
+// client and commands pick it up on their next use; collector schedules,
+// the NATS or WebSocket connection and the command subject keep theirs
+// until the agent restarts.
+func reload() {
+	if _, err := config.Reload(); err != nil {
+		console.Error("Error reloading config, keeping the previous one: " + err.Error())
+		return
+	}
+
+	console.Success("Configuration reloaded")
+}
+
+// jobs builds the collector schedule. Intercept and process list follow
+// Config.Interval; services, software inventory and power change rarely and
+// get slower intervals from config.Defaults. Any of them can be overridden
+// from the "schedules" section of the configuration.
+func (magnesia Magnesia) jobs(cfg config.Config) []scheduler.Job {
+	interval := cfg.Interval.Duration
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	jobs := []scheduler.Job{
+		{Name: "intercept", Run: magnesia.Intercept},
+		{Name: "processlist", Run: func() { magnesia.ProcessList() }},
+		{Name: "services", Run: interceptor.GetServices},
+		{Name: "installations", Run: interceptor.InstalledSoftwareList},
+		{Name: "power", Run: func() { interceptor.BatteryInfo(true) }},
+	}
+
+	for i, job := range jobs {
+		schedule := cfg.Schedules[job.Name]
+
+		job.Interval = interval
+		if schedule.Interval != nil {
+			job.Interval = schedule.Interval.Duration
+		}
+
+		job.Jitter = min(job.Interval, maxDefaultJitter)
+		if schedule.Jitter != nil {
+			job.Jitter = schedule.Jitter.Duration
+		}
+
+		jobs[i] = job
+	}
+
+	return jobs
+}
@@ -0,0 +1,79 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/auh-xda/magnesia/console"
+	"golang.org/x/sys/windows/svc"
+)
+
+const serviceName = "MagnesiaAgent"
+
+type agentService struct {
+	run func(ctx context.Context)
+}
+
+// serve hands control to the service control manager when started as a
+// Windows service, otherwise it runs in the foreground until Ctrl+C.
+func serve(run func(ctx context.Context)) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		console.Error("Unable to detect service mode: " + err.Error())
+	}
+
+	if !isService {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		run(ctx)
+		return
+	}
+
+	if err := svc.Run(serviceName, &agentService{run: run}); err != nil {
+		console.Error("Service failed: " + err.Error())
+	}
+}
+
+// watchReload does nothing: Windows has no SIGHUP, the reload command
+// covers it.
+func watchReload(ctx context.Context, reload func()) {}
+
+func (s *agentService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+
+	status <- svc.Status{State: svc.StartPending}
+
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			return false, 0
+
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package chunk splits envelopes too large for one NATS message and puts
+// them back together. Like envelope it depends on nothing else in the
+// agent, so Momentum can import it.
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers carried by every chunk of a split message. ID is shared by all
+// chunks of one message, Index counts from 0 and Count is the total. Any
+// Content-Encoding applies to the reassembled message, not to a chunk.
+const (
+	IDHeader    = "Magnesia-Chunk-Id"
+	IndexHeader = "Magnesia-Chunk-Index"
+	CountHeader = "Magnesia-Chunk-Count"
+)
+
+// MaxCount bounds how many chunks a message may claim.
+const MaxCount = 4096
+
+// Defaults for the Assembler limits that are not set.
+const (
+	DefaultMaxAge      = 5 * time.Minute
+	DefaultMaxBytes    = 64 << 20
+	DefaultMaxBuffered = 256 << 20
+	DefaultMaxMessages = 1024
+)
+
+// ErrLimit is returned, wrapped, for a chunk that would take the assembler
+// past one of its limits.
+var ErrLimit = errors.New("chunk limit exceeded")
+
+// Split cuts data into pieces of at most size bytes. Data that fits, or a
+// size that is not positive, gives a single piece.
+func Split(data []byte, size int) [][]byte {
+	if size <= 0 || len(data) <= size {
+		return [][]byte{data}
+	}
+
+	parts := make([][]byte, 0, (len(data)+size-1)/size)
+	for len(data) > size {
+		parts = append(parts, data[:size:size])
+		data = data[size:]
+	}
+
+	return append(parts, data)
+}
+
+// Assembler collects chunks until a message is complete. Chunks may arrive
+// in any order and more than once; copies arriving within MaxAge after
+// their message was completed are ignored. Chunks come from the network, so
+// memory is bounded: a message may not grow past MaxBytes, all incomplete
+// messages together may not hold more than MaxBuffered bytes, and at most
+// MaxMessages may be incomplete at once. A chunk that would break a limit
+// is rejected with ErrLimit and the rest of its message is dropped. Zero
+// limits take the defaults. It is safe for concurrent use.
+type Assembler struct {
+	MaxAge      time.Duration
+	MaxBytes    int
+	MaxBuffered int
+	MaxMessages int
+
+	mu       sync.Mutex
+	messages map[string]*message
+	buffered int
+	done     map[string]time.Time
+	order    []string
+}
+
+type message struct {
+	parts   map[int][]byte
+	count   int
+	size    int
+	started time.Time
+}
+
+// Add takes one message with its headers. A message that was not split is
+// returned as it is. For a chunk it returns the reassembled message and
+// true once the last chunk arrived, and false until then.
+func (a *Assembler) Add(header map[string][]string, data []byte) ([]byte, bool, error) {
+	id := first(header, IDHeader)
+	if id == "" {
+		return data, true, nil
+	}
+
+	index, err := strconv.Atoi(first(header, IndexHeader))
+	if err != nil {
+		return nil, false, fmt.Errorf("chunk %s: invalid index: %v", id, err)
+	}
+
+	count, err := strconv.Atoi(first(header, CountHeader))
+	if err != nil {
+		return nil, false, fmt.Errorf("chunk %s: invalid count: %v", id, err)
+	}
+
+	if count < 1 || count > MaxCount || index < 0 || index >= count {
+		return nil, false, fmt.Errorf("chunk %s: index %d of %d is out of range", id, index, count)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.prune()
+
+	if _, ok := a.done[id]; ok {
+		return nil, false, nil
+	}
+
+	if a.messages == nil {
+		a.messages = map[string]*message{}
+		a.done = map[string]time.Time{}
+	}
+
+	m, ok := a.messages[id]
+	if !ok {
+		if len(a.messages) >= limit(a.MaxMessages, DefaultMaxMessages) {
+			return nil, false, fmt.Errorf("chunk %s: %w, %d messages are already incomplete", id, ErrLimit, len(a.messages))
+		}
+		m = &message{parts: map[int][]byte{}, count: count, started: time.Now()}
+		a.messages[id] = m
+	}
+
+	if m.count != count {
+		a.drop(id)
+		return nil, false, fmt.Errorf("chunk %s: count %d does not match %d seen before, message dropped", id, count, m.count)
+	}
+
+	if _, ok := m.parts[index]; ok {
+		return nil, false, nil
+	}
+
+	if maxBytes := limit(a.MaxBytes, DefaultMaxBytes); m.size+len(data) > maxBytes {
+		a.drop(id)
+		return nil, false, fmt.Errorf("chunk %s: %w, message is larger than %d bytes, dropped", id, ErrLimit, maxBytes)
+	}
+
+	if maxBuffered := limit(a.MaxBuffered, DefaultMaxBuffered); a.buffered+len(data) > maxBuffered {
+		a.drop(id)
+		return nil, false, fmt.Errorf("chunk %s: %w, incomplete messages hold more than %d bytes, message dropped", id, ErrLimit, maxBuffered)
+	}
+
+	m.parts[index] = append([]byte{}, data...)
+	m.size += len(data)
+	a.buffered += len(data)
+
+	if len(m.parts) < count {
+		return nil, false, nil
+	}
+
+	a.drop(id)
+	a.done[id] = time.Now()
+	a.order = append(a.order, id)
+
+	whole := make([]byte, 0, m.size)
+	for i := 0; i < count; i++ {
+		whole = append(whole, m.parts[i]...)
+	}
+
+	return whole, true, nil
+}
+
+// Pending is the number of messages still missing chunks.
+func (a *Assembler) Pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.prune()
+
+	return len(a.messages)
+}
+
+// drop forgets the incomplete message id.
+func (a *Assembler) drop(id string) {
+	if m, ok := a.messages[id]; ok {
+		a.buffered -= m.size
+		delete(a.messages, id)
+	}
+}
+
+// prune forgets messages whose remaining chunks did not arrive in time,
+// and completed messages old enough that no more copies are expected.
+// Completed IDs are remembered up to 16 times MaxMessages.
+func (a *Assembler) prune() {
+	maxAge := a.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+
+	for id, m := range a.messages {
+		if time.Since(m.started) > maxAge {
+			a.drop(id)
+		}
+	}
+
+	maxDone := 16 * limit(a.MaxMessages, DefaultMaxMessages)
+
+	// order holds completed IDs oldest first
+	n := 0
+	for n < len(a.order) && (len(a.order)-n > maxDone || time.Since(a.done[a.order[n]]) > maxAge) {
+		delete(a.done, a.order[n])
+		n++
+	}
+	a.order = a.order[n:]
+}
+
+func limit(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+func first(header map[string][]string, key string) string {
+	if values := header[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
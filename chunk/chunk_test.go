@@ -0,0 +1,277 @@
+package chunk
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func header(id string, index, count int) map[string][]string {
+	return map[string][]string{
+		IDHeader:    {id},
+		IndexHeader: {strconv.Itoa(index)},
+		CountHeader: {strconv.Itoa(count)},
+	}
+}
+
+func TestSplit(t *testing.T) {
+	data := []byte("0123456789")
+
+	tests := []struct {
+		name string
+		size int
+		want []string
+	}{
+		{"fits", 10, []string{"0123456789"}},
+		{"larger size", 64, []string{"0123456789"}},
+		{"no size", 0, []string{"0123456789"}},
+		{"negative size", -1, []string{"0123456789"}},
+		{"even", 5, []string{"01234", "56789"}},
+		{"remainder", 4, []string{"0123", "4567", "89"}},
+		{"single bytes", 1, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := Split(data, tt.size)
+			if len(parts) != len(tt.want) {
+				t.Fatalf("Split gave %d parts, want %d", len(parts), len(tt.want))
+			}
+			for i, part := range parts {
+				if string(part) != tt.want[i] {
+					t.Errorf("part %d = %q, want %q", i, part, tt.want[i])
+				}
+			}
+		})
+	}
+
+	// appending to a part must not overwrite the next one
+	parts := Split(data, 4)
+	_ = append(parts[0], 'x')
+	if string(parts[1]) != "4567" {
+		t.Errorf("appending to a part changed the next to %q", parts[1])
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	data := bytes.Repeat([]byte("magnesia"), 100)
+	parts := Split(data, 64)
+	count := len(parts)
+
+	type chunk struct {
+		index, count int
+		data         []byte
+	}
+
+	inOrder := make([]chunk, count)
+	for i, part := range parts {
+		inOrder[i] = chunk{i, count, part}
+	}
+
+	reversed := make([]chunk, count)
+	for i, c := range inOrder {
+		reversed[count-1-i] = c
+	}
+
+	withDuplicates := []chunk{}
+	for _, c := range inOrder {
+		withDuplicates = append(withDuplicates, c, c)
+	}
+
+	shuffled := append([]chunk{}, inOrder...)
+	shuffled[0], shuffled[5] = shuffled[5], shuffled[0]
+	shuffled[2], shuffled[count-1] = shuffled[count-1], shuffled[2]
+
+	tests := []struct {
+		name   string
+		chunks []chunk
+	}{
+		{"in order", inOrder},
+		{"reversed", reversed},
+		{"shuffled", shuffled},
+		{"duplicates", withDuplicates},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Assembler{}
+			completed := 0
+
+			for i, c := range tt.chunks {
+				whole, ok, err := a.Add(header("m1", c.index, c.count), c.data)
+				if err != nil {
+					t.Fatalf("chunk %d: %v", i, err)
+				}
+				if !ok {
+					continue
+				}
+				completed++
+				if !bytes.Equal(whole, data) {
+					t.Fatalf("reassembled %d bytes, want the original %d", len(whole), len(data))
+				}
+			}
+
+			if completed != 1 {
+				t.Errorf("message completed %d times, want once", completed)
+			}
+			if a.Pending() != 0 {
+				t.Errorf("Pending = %d after completion", a.Pending())
+			}
+
+			// a late copy of a chunk must not start the message over
+			if _, ok, err := a.Add(header("m1", 0, count), parts[0]); ok || err != nil {
+				t.Errorf("late duplicate: ok = %v, err = %v", ok, err)
+			}
+			if a.Pending() != 0 {
+				t.Errorf("late duplicate left %d pending messages", a.Pending())
+			}
+		})
+	}
+}
+
+func TestAssembleRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		assembler *Assembler
+		adds      []map[string][]string
+		size      int
+		wantErr   int // index of the add that fails
+		limit     bool
+		pending   int
+	}{
+		{
+			name:      "mismatched count",
+			assembler: &Assembler{},
+			adds:      []map[string][]string{header("m", 0, 3), header("m", 1, 4)},
+			size:      8, wantErr: 1, pending: 0,
+		},
+		{
+			name:      "index out of range",
+			assembler: &Assembler{},
+			adds:      []map[string][]string{header("m", 3, 3)},
+			size:      8, wantErr: 0, pending: 0,
+		},
+		{
+			name:      "negative index",
+			assembler: &Assembler{},
+			adds:      []map[string][]string{header("m", -1, 3)},
+			size:      8, wantErr: 0, pending: 0,
+		},
+		{
+			name:      "too many chunks",
+			assembler: &Assembler{},
+			adds:      []map[string][]string{header("m", 0, MaxCount+1)},
+			size:      8, wantErr: 0, pending: 0,
+		},
+		{
+			name:      "bad index header",
+			assembler: &Assembler{},
+			adds:      []map[string][]string{{IDHeader: {"m"}, IndexHeader: {"x"}, CountHeader: {"2"}}},
+			size:      8, wantErr: 0, pending: 0,
+		},
+		{
+			name:      "message too large",
+			assembler: &Assembler{MaxBytes: 20},
+			adds:      []map[string][]string{header("m", 0, 3), header("m", 1, 3), header("m", 2, 3)},
+			size:      8, wantErr: 2, limit: true, pending: 0,
+		},
+		{
+			name:      "too much buffered",
+			assembler: &Assembler{MaxBuffered: 20},
+			adds:      []map[string][]string{header("a", 0, 2), header("b", 0, 2), header("c", 0, 2)},
+			size:      8, wantErr: 2, limit: true, pending: 2,
+		},
+		{
+			name:      "too many messages",
+			assembler: &Assembler{MaxMessages: 2},
+			adds:      []map[string][]string{header("a", 0, 2), header("b", 0, 2), header("c", 0, 2)},
+			size:      8, wantErr: 2, limit: true, pending: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := tt.assembler
+			data := bytes.Repeat([]byte{'x'}, tt.size)
+
+			for i, h := range tt.adds {
+				_, _, err := a.Add(h, data)
+
+				if i != tt.wantErr {
+					if err != nil {
+						t.Fatalf("add %d: %v", i, err)
+					}
+					continue
+				}
+
+				if err == nil {
+					t.Fatalf("add %d succeeded, want an error", i)
+				}
+				if errors.Is(err, ErrLimit) != tt.limit {
+					t.Errorf("add %d: errors.Is(ErrLimit) = %v, want %v (%v)", i, !tt.limit, tt.limit, err)
+				}
+				break
+			}
+
+			if a.Pending() != tt.pending {
+				t.Errorf("Pending = %d, want %d", a.Pending(), tt.pending)
+			}
+		})
+	}
+}
+
+func TestAssembleFreesDroppedMessages(t *testing.T) {
+	a := &Assembler{MaxBytes: 16, MaxBuffered: 24}
+	data := bytes.Repeat([]byte{'x'}, 8)
+
+	// the oversized message is dropped, and its bytes no longer count
+	a.Add(header("big", 0, 3), data)
+	a.Add(header("big", 1, 3), data)
+	if _, _, err := a.Add(header("big", 2, 3), data); !errors.Is(err, ErrLimit) {
+		t.Fatalf("oversized message: err = %v", err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if _, _, err := a.Add(header(id, 0, 2), data); err != nil {
+			t.Fatalf("message %s after a drop: %v", id, err)
+		}
+	}
+
+	// a dropped message can be sent again from the start
+	a = &Assembler{MaxBytes: 16}
+	a.Add(header("m", 0, 2), data)
+	a.Add(header("m", 1, 3), data)
+	a.Add(header("m", 0, 2), data)
+	whole, ok, err := a.Add(header("m", 1, 2), data)
+	if err != nil || !ok || len(whole) != 16 {
+		t.Errorf("resent message: %d bytes, ok = %v, err = %v", len(whole), ok, err)
+	}
+}
+
+func TestAssembleExpires(t *testing.T) {
+	a := &Assembler{MaxAge: 20 * time.Millisecond}
+
+	if _, ok, _ := a.Add(header("m", 0, 2), []byte("a")); ok {
+		t.Fatal("incomplete message returned")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	if a.Pending() != 0 {
+		t.Errorf("Pending = %d after MaxAge", a.Pending())
+	}
+	if a.buffered != 0 {
+		t.Errorf("%d bytes still buffered after MaxAge", a.buffered)
+	}
+}
+
+func TestUnsplitMessage(t *testing.T) {
+	a := &Assembler{}
+
+	whole, ok, err := a.Add(map[string][]string{"Content-Encoding": {"zstd"}}, []byte("plain"))
+	if err != nil || !ok || string(whole) != "plain" {
+		t.Errorf("Add = %q, %v, %v", whole, ok, err)
+	}
+}
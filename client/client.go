@@ -1,21 +1,187 @@
 package client
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/identity"
+	"github.com/auh-xda/magnesia/tlsconfig"
 	"github.com/go-resty/resty/v2"
 )
 
-const momentum = "http://192.168.3.53:1235"
+var (
+	momentum   string
+	momentumMu sync.RWMutex
+)
+
+// SetBaseURL points the client at a Momentum server, overriding the
+// "server" value from config.json. Install uses it before a config exists.
+func SetBaseURL(url string) {
+	momentumMu.Lock()
+	defer momentumMu.Unlock()
+
+	momentum = strings.TrimRight(url, "/")
+}
+
+// BaseURL is the Momentum server requests are sent to.
+func BaseURL() string {
+	momentumMu.RLock()
+	url := momentum
+	momentumMu.RUnlock()
+
+	if url != "" {
+		return url
+	}
+
+	cfg, _ := config.ParseConfig()
+
+	return strings.TrimRight(cfg.Momentum, "/")
+}
+
+func Init() (*resty.Client, error) {
+	conf, err := tlsconfig.New(settings().TLS)
+	if err != nil {
+		return nil, err
+	}
 
-func Init() *resty.Client {
 	return resty.New().
-		SetBaseURL(momentum).
-		SetHeader("Content-Type", "application/json")
+		SetBaseURL(BaseURL()).
+		SetHeader("Content-Type", "application/json").
+		SetTLSClientConfig(conf).
+		SetPreRequestHook(sign), nil
+}
+
+// settings is the resolved configuration, or before install everything
+// but config.json, so enrollment honours TLS settings from the
+// environment, flags and conf.d.
+func settings() config.Config {
+	if cfg, err := config.ParseConfig(); err == nil {
+		return cfg
+	}
+
+	cfg, _ := config.Bootstrap()
+
+	return cfg
+}
+
+// sign adds the agent's signature headers once it has a key, so Momentum
+// can tell which agent sent a request. Before enrollment requests go out
+// unsigned.
+func sign(_ *resty.Client, req *http.Request) error {
+	if _, err := os.Stat(identity.SeedPath()); err != nil {
+		return nil
+	}
+
+	body, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+
+	return identity.SignRequest(req, body)
+}
+
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return nil, nil
+	}
+
+	r, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// Prepare builds a client that no longer reads the config directory: the
+// server, TLS files and agent key are loaded now. Remove uses it to
+// deregister once the directory is gone. release wipes the key.
+func Prepare() (c *resty.Client, release func(), err error) {
+	target := BaseURL()
+	if target == "" {
+		return nil, nil, fmt.Errorf("no Momentum server configured, set \"server\" in config.json or pass -server")
+	}
+
+	tls := settings().TLS
+	if tls.Strict && tlsconfig.Plaintext(target) {
+		return nil, nil, fmt.Errorf("refusing plaintext request to %s, tls.strict is set", target)
+	}
+
+	conf, err := tlsconfig.New(tls)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kp, err := identity.Load()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	c = resty.New().
+		SetBaseURL(target).
+		SetHeader("Content-Type", "application/json").
+		SetTLSClientConfig(conf).
+		SetPreRequestHook(func(_ *resty.Client, req *http.Request) error {
+			if kp == nil {
+				return nil
+			}
+			body, err := requestBody(req)
+			if err != nil {
+				return err
+			}
+			return identity.SignRequestWith(kp, req, body)
+		})
+
+	release = func() {
+		if kp != nil {
+			kp.Wipe()
+		}
+	}
+
+	return c, release, nil
 }
 
 func Get(endpoint string) (*resty.Response, error) {
-	return Init().R().Get(endpoint)
+	c, err := request(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return c.R().Get(endpoint)
 }
 
 func Post(endpoint string, body interface{}) (*resty.Response, error) {
-	return Init().R().SetBody(body).Post(endpoint)
+	return PostWithHeaders(endpoint, body, nil)
+}
+
+// PostWithHeaders is Post with extra request headers, such as the
+// Content-Encoding of a compressed body.
+func PostWithHeaders(endpoint string, body interface{}, headers map[string]string) (*resty.Response, error) {
+	c, err := request(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return c.R().SetHeaders(headers).SetBody(body).Post(endpoint)
+}
+
+func request(endpoint string) (*resty.Client, error) {
+	target := endpoint
+	if !strings.Contains(endpoint, "://") {
+		target = BaseURL()
+	}
+
+	if target == "" {
+		return nil, fmt.Errorf("no Momentum server configured, set \"server\" in config.json or pass -server")
+	}
+
+	if settings().TLS.Strict && tlsconfig.Plaintext(target) {
+		return nil, fmt.Errorf("refusing plaintext request to %s, tls.strict is set", target)
+	}
+
+	return Init()
 }
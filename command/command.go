@@ -0,0 +1,144 @@
+package command
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/auh-xda/magnesia/console"
+	"github.com/nats-io/nkeys"
+)
+
+// maxCommandAge bounds how old a command may be when it arrives; together
+// with the executed IDs kept in config.Commands it stops a captured command
+// from being replayed, across restarts too.
+const maxCommandAge = 5 * time.Minute
+
+// Request is what the server sends: the command exactly as it was signed,
+// and the base64 Ed25519 signature made with the server's nkey.
+type Request struct {
+	Command   json.RawMessage `json:"command"`
+	Signature string          `json:"signature"`
+}
+
+type Command struct {
+	ID       string          `json:"id"`
+	Name     string          `json:"name"`
+	Args     json.RawMessage `json:"args,omitempty"`
+	IssuedAt time.Time       `json:"issued_at"`
+}
+
+type Result struct {
+	ID         string `json:"id"`
+	Command    string `json:"command"`
+	Status     string `json:"status"`
+	Output     any    `json:"output,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+type Handler func(cmd Command) (any, error)
+
+var handlers = map[string]Handler{}
+
+// Register makes a command available to the server under name.
+func Register(name string, handler Handler) {
+	handlers[name] = handler
+}
+
+// Bind decodes the command arguments into v.
+func (cmd Command) Bind(v any) error {
+	if len(cmd.Args) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(cmd.Args, v); err != nil {
+		return fmt.Errorf("invalid arguments for %s: %v", cmd.Name, err)
+	}
+
+	return nil
+}
+
+// Dispatch verifies a signed request against the server public key, runs
+// the matching handler and returns the encoded Result to reply with.
+func Dispatch(data []byte, publicKey string) []byte {
+	start := time.Now()
+
+	cmd, err := verify(data, publicKey)
+
+	result := Result{ID: cmd.ID, Command: cmd.Name, Status: "ok"}
+
+	if err == nil {
+		console.Info(fmt.Sprintf("Running remote command %s (%s)", cmd.Name, cmd.ID))
+		result.Output, err = run(cmd)
+	}
+
+	if err != nil {
+		console.Error(fmt.Sprintf("Remote command %s failed: %s", cmd.Name, err.Error()))
+		result.Status = "error"
+		result.Error = err.Error()
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+
+	reply, _ := json.Marshal(result)
+
+	return reply
+}
+
+func run(cmd Command) (output any, err error) {
+	handler, ok := handlers[cmd.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q", cmd.Name)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("command panicked: %v", r)
+		}
+	}()
+
+	return handler(cmd)
+}
+
+func verify(data []byte, publicKey string) (Command, error) {
+	var req Request
+	var cmd Command
+
+	if err := json.Unmarshal(data, &req); err != nil {
+		return cmd, fmt.Errorf("malformed request: %v", err)
+	}
+
+	if err := json.Unmarshal(req.Command, &cmd); err != nil {
+		return cmd, fmt.Errorf("malformed command: %v", err)
+	}
+
+	if publicKey == "" {
+		return cmd, fmt.Errorf("remote commands are disabled, no command_key configured")
+	}
+
+	kp, err := nkeys.FromPublicKey(publicKey)
+	if err != nil {
+		return cmd, fmt.Errorf("invalid command_key: %v", err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		return cmd, fmt.Errorf("malformed signature: %v", err)
+	}
+
+	if err := kp.Verify(req.Command, sig); err != nil {
+		return cmd, fmt.Errorf("signature verification failed")
+	}
+
+	if cmd.ID == "" {
+		return cmd, fmt.Errorf("command has no id")
+	}
+
+	if age := time.Since(cmd.IssuedAt); age > maxCommandAge || age < -maxCommandAge {
+		return cmd, fmt.Errorf("command issued at %s is outside the accepted window", cmd.IssuedAt.Format(time.RFC3339))
+	}
+
+	return cmd, seen.record(cmd)
+}
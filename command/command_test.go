@@ -0,0 +1,165 @@
+package command
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/nats-io/nkeys"
+)
+
+type signer struct {
+	t  *testing.T
+	kp nkeys.KeyPair
+}
+
+func newSigner(t *testing.T) signer {
+	kp, err := nkeys.CreateAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer{t, kp}
+}
+
+func (s signer) public() string {
+	public, err := s.kp.PublicKey()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return public
+}
+
+func (s signer) request(id string, issuedAt time.Time) []byte {
+	cmd, err := json.Marshal(Command{ID: id, Name: "ping", IssuedAt: issuedAt})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	sig, err := s.kp.Sign(cmd)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	req, err := json.Marshal(Request{Command: cmd, Signature: base64.StdEncoding.EncodeToString(sig)})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return req
+}
+
+// restart forgets what the running agent remembered, as a new process would.
+func restart() {
+	seen = &seenIDs{}
+}
+
+func TestVerify(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+	restart()
+
+	server := newSigner(t)
+	other := newSigner(t)
+	now := time.Now().Add(time.Second)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		key     string
+		wantErr string
+	}{
+		{"valid", server.request("a", now), server.public(), ""},
+		{"replayed", server.request("a", now), server.public(), "already executed"},
+		{"other key", other.request("b", now), server.public(), "signature verification failed"},
+		{"no key", server.request("c", now), "", "disabled"},
+		{"no id", server.request("", now), server.public(), "no id"},
+		{"too old", server.request("d", now.Add(-10*time.Minute)), server.public(), "outside the accepted window"},
+		{"too far ahead", server.request("e", now.Add(10*time.Minute)), server.public(), "outside the accepted window"},
+		{"malformed", []byte("{"), server.public(), "malformed request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verify(tt.data, tt.key)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verify = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSeenSurvivesRestart(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+	restart()
+
+	server := newSigner(t)
+	key := server.public()
+
+	// with no record of earlier runs, older commands may have run already
+	if _, err := verify(server.request("early", time.Now().Add(-time.Minute)), key); err == nil {
+		t.Error("accepted a command issued before the agent started, with no record")
+	}
+
+	issued := time.Now().Add(time.Second)
+	if _, err := verify(server.request("a", issued), key); err != nil {
+		t.Fatal(err)
+	}
+
+	restart()
+
+	if _, err := verify(server.request("a", issued), key); err == nil {
+		t.Error("accepted a command executed before the restart")
+	}
+	if _, err := verify(server.request("b", time.Now().Add(-time.Minute)), key); err != nil {
+		t.Errorf("rejected a new command issued before the restart: %v", err)
+	}
+
+	// expired IDs are dropped from the file
+	seen.ids["old"] = time.Now().Add(-time.Second)
+	if _, err := verify(server.request("c", time.Now()), key); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(config.Commands())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]time.Time
+	if err := json.Unmarshal(content, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved["old"]; ok || len(saved) != 3 {
+		t.Errorf("saved IDs = %v, want a, b and c", saved)
+	}
+}
+
+func TestSeenCorruptFile(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+	restart()
+
+	if err := os.MkdirAll(filepath.Dir(config.Commands()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.Commands(), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newSigner(t)
+
+	if _, err := verify(server.request("a", time.Now().Add(-time.Minute)), server.public()); err == nil {
+		t.Error("accepted a command issued before the agent started, with a corrupt record")
+	}
+	if _, err := verify(server.request("b", time.Now().Add(time.Second)), server.public()); err != nil {
+		t.Errorf("rejected a command issued after the agent started: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+)
+
+// seenIDs remembers executed command IDs, each until its command is too old
+// to pass verify. They are kept on disk, so a restart does not reopen the
+// window for a captured command.
+type seenIDs struct {
+	mu     sync.Mutex
+	loaded bool
+	ids    map[string]time.Time
+
+	// notBefore rejects commands issued before the agent started when
+	// there is no record of what ran before it
+	notBefore time.Time
+}
+
+var seen = &seenIDs{}
+
+// record accepts cmd unless its ID was executed before, and saves the ID
+// before the command runs.
+func (s *seenIDs) record(cmd Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.loaded {
+		s.load()
+		s.loaded = true
+	}
+
+	if cmd.IssuedAt.Before(s.notBefore) {
+		return fmt.Errorf("command %s was issued before the agent started and could be a replay", cmd.ID)
+	}
+
+	now := time.Now()
+	for id, expires := range s.ids {
+		if now.After(expires) {
+			delete(s.ids, id)
+		}
+	}
+
+	if _, replayed := s.ids[cmd.ID]; replayed {
+		return fmt.Errorf("command %s was already executed", cmd.ID)
+	}
+
+	s.ids[cmd.ID] = cmd.IssuedAt.Add(maxCommandAge)
+
+	if err := s.save(); err != nil {
+		delete(s.ids, cmd.ID)
+		return fmt.Errorf("failed to record command %s: %v", cmd.ID, err)
+	}
+
+	return nil
+}
+
+func (s *seenIDs) load() {
+	s.ids = map[string]time.Time{}
+
+	content, err := os.ReadFile(config.Commands())
+	if err == nil {
+		if err = json.Unmarshal(content, &s.ids); err == nil {
+			return
+		}
+		s.ids = map[string]time.Time{}
+		console.Warn(fmt.Sprintf("Invalid executed command list %s: %v", config.Commands(), err))
+	}
+
+	// without a record, anything issued before now may already have run
+	s.notBefore = time.Now()
+}
+
+func (s *seenIDs) save() error {
+	path := config.Commands()
+
+	data, err := json.Marshal(s.ids)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
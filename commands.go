@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/auh-xda/magnesia/command"
+	"github.com/auh-xda/magnesia/compression"
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/installer"
+	"github.com/auh-xda/magnesia/interceptor"
+	"github.com/auh-xda/magnesia/nats"
+	"github.com/auh-xda/magnesia/script"
+	"github.com/auh-xda/magnesia/servicectl"
+)
+
+// listen registers the remote commands and subscribes to the agent's
+// command subject. Collection commands publish through the usual path and
+// reply with a short summary. Handlers read the configuration when they
+// run, so a reload applies to the next command; the subject is fixed.
+func (magnesia Magnesia) listen(cfg config.Config) {
+	command.Register("ping", func(cmd command.Command) (any, error) {
+		return map[string]string{"pong": current(cfg).UUID, "version": version}, nil
+	})
+
+	command.Register("intercept", func(cmd command.Command) (any, error) {
+		magnesia.Intercept()
+		return "intercept published", nil
+	})
+
+	command.Register("processlist", func(cmd command.Command) (any, error) {
+		processes := magnesia.ProcessList()
+		return fmt.Sprintf("%d processes published", len(processes)), nil
+	})
+
+	command.Register("services", func(cmd command.Command) (any, error) {
+		interceptor.GetServices()
+		return "services published", nil
+	})
+
+	command.Register("installations", func(cmd command.Command) (any, error) {
+		interceptor.InstalledSoftwareList()
+		return "installations published", nil
+	})
+
+	command.Register("power", func(cmd command.Command) (any, error) {
+		return interceptor.BatteryInfo(true), nil
+	})
+
+	command.Register("service", func(cmd command.Command) (any, error) {
+		var args struct {
+			Name   string `json:"name"`
+			Action string `json:"action"`
+		}
+		if err := cmd.Bind(&args); err != nil {
+			return nil, err
+		}
+		return servicectl.Control(current(cfg).ServiceControl, args.Action, args.Name)
+	})
+
+	command.Register("script", func(cmd command.Command) (any, error) {
+		var job script.Job
+		if err := cmd.Bind(&job); err != nil {
+			return nil, err
+		}
+
+		cfg := current(cfg)
+
+		// Run refuses an invalid ID before any output, so only a valid one
+		// ever becomes part of the subject
+		subject := nats.JobSubject(cfg, job.ID)
+
+		result := script.Run(cfg.Scripts, job, func(chunk script.Chunk) {
+			if err := nats.Publish(subject, chunk); err != nil {
+				console.Error("Error streaming script output: " + err.Error())
+			}
+		})
+
+		if script.ValidID(job.ID) {
+			if err := nats.Publish(subject, result); err != nil {
+				console.Error("Error publishing script result: " + err.Error())
+			}
+		}
+
+		if result.Error != "" {
+			return result, fmt.Errorf("%s", result.Error)
+		}
+		return result, nil
+	})
+
+	// the update restarts this service, so it runs in a detached process
+	command.Register("update", func(cmd command.Command) (any, error) {
+		var args struct {
+			Force bool `json:"force"`
+		}
+		if err := cmd.Bind(&args); err != nil {
+			return nil, err
+		}
+
+		updateArgs := []string{"-action", "update"}
+		if args.Force {
+			updateArgs = append(updateArgs, "-force")
+		}
+
+		if err := installer.Detach("update", updateArgs...); err != nil {
+			return nil, err
+		}
+		return "update started", nil
+	})
+
+	command.Register("info", func(cmd command.Command) (any, error) {
+		cfg, err := config.ParseConfig()
+		return cfg.Public(), err
+	})
+
+	command.Register("reload", func(cmd command.Command) (any, error) {
+		if _, err := config.Reload(); err != nil {
+			return nil, err
+		}
+		return "configuration reloaded", nil
+	})
+
+	command.Register("stats", func(cmd command.Command) (any, error) {
+		return map[string]any{"compression": compression.Snapshot()}, nil
+	})
+
+	if cfg.CommandKey == "" {
+		console.Warn("No command_key configured, remote commands will be rejected")
+	}
+
+	err := nats.Serve(nats.CommandSubject(cfg), func(data []byte) []byte {
+		return command.Dispatch(data, current(cfg).CommandKey)
+	})
+
+	if err != nil {
+		console.Error("Error subscribing to commands: " + err.Error())
+	}
+}
+
+// current is the configuration as of the last reload, or cfg from startup
+// if it can no longer be resolved.
+func current(cfg config.Config) config.Config {
+	if latest, err := config.ParseConfig(); err == nil {
+		return latest
+	}
+	return cfg
+}
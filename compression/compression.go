@@ -0,0 +1,202 @@
+// Package compression shrinks large envelopes before they go over the
+// network. Like envelope it depends on nothing else in the agent, so
+// Momentum can import it to decode what it receives.
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithms an envelope can be encoded with.
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Header carries the algorithm of a compressed envelope on NATS and HTTP,
+// as in HTTP. An envelope without it is plain JSON.
+const Header = "Content-Encoding"
+
+// DefaultMinSize is the smallest envelope compressed when no threshold is
+// configured. Below it the saving rarely pays for the CPU.
+const DefaultMinSize = 16 * 1024
+
+// DefaultMaxDecoded is the largest message Decode produces. A few KiB of
+// zstd or gzip can expand to gigabytes, so decoding stops there.
+const DefaultMaxDecoded = 64 << 20
+
+// ErrTooLarge is returned, wrapped, when decoded data would exceed the
+// limit.
+var ErrTooLarge = errors.New("decoded data is too large")
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// Encode compresses data with algorithm when it is at least minSize bytes
+// long, or DefaultMinSize when minSize is 0. It returns the bytes to send
+// and the algorithm used, which is None when data was left alone because it
+// was too small or would not shrink.
+func Encode(data []byte, algorithm string, minSize int) ([]byte, string, error) {
+	if algorithm == "" || algorithm == None {
+		return data, None, nil
+	}
+
+	if minSize == 0 {
+		minSize = DefaultMinSize
+	}
+
+	if len(data) < minSize {
+		record(algorithm, len(data), len(data), false)
+		return data, None, nil
+	}
+
+	var encoded []byte
+
+	switch algorithm {
+	case Zstd:
+		encoded = zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/4))
+
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", err
+		}
+		encoded = buf.Bytes()
+
+	default:
+		return nil, "", fmt.Errorf("unknown compression %q", algorithm)
+	}
+
+	if len(encoded) >= len(data) {
+		record(algorithm, len(data), len(data), false)
+		return data, None, nil
+	}
+
+	record(algorithm, len(data), len(encoded), true)
+
+	return encoded, algorithm, nil
+}
+
+// Decode reverses Encode, up to DefaultMaxDecoded bytes.
+func Decode(data []byte, algorithm string) ([]byte, error) {
+	return DecodeLimit(data, algorithm, DefaultMaxDecoded)
+}
+
+// DecodeLimit reverses Encode and fails with ErrTooLarge instead of
+// producing more than limit bytes.
+func DecodeLimit(data []byte, algorithm string, limit int) ([]byte, error) {
+	switch algorithm {
+	case "", None:
+		if len(data) > limit {
+			return nil, tooLarge(limit)
+		}
+		return data, nil
+
+	case Zstd:
+		r, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		decoded, err := readLimit(r, limit)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, tooLarge(limit)
+		}
+		return decoded, err
+
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		return readLimit(r, limit)
+
+	default:
+		return nil, fmt.Errorf("unknown compression %q", algorithm)
+	}
+}
+
+func readLimit(r io.Reader, limit int) ([]byte, error) {
+	decoded, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decoded) > limit {
+		return nil, tooLarge(limit)
+	}
+
+	return decoded, nil
+}
+
+func tooLarge(limit int) error {
+	return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, limit)
+}
+
+// Stats counts the envelopes offered to one algorithm since the agent
+// started. Skipped ones were sent as is and count the same size on both
+// sides, so Ratio is the overall saving on the wire.
+type Stats struct {
+	Algorithm    string  `json:"algorithm"`
+	Compressed   uint64  `json:"compressed"`
+	Skipped      uint64  `json:"skipped"`
+	RawBytes     uint64  `json:"raw_bytes"`
+	EncodedBytes uint64  `json:"encoded_bytes"`
+	Ratio        float64 `json:"ratio"`
+}
+
+var (
+	stats   = map[string]*Stats{}
+	statsMu sync.Mutex
+)
+
+func record(algorithm string, raw, encoded int, compressed bool) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	s, ok := stats[algorithm]
+	if !ok {
+		s = &Stats{Algorithm: algorithm}
+		stats[algorithm] = s
+	}
+
+	if compressed {
+		s.Compressed++
+	} else {
+		s.Skipped++
+	}
+
+	s.RawBytes += uint64(raw)
+	s.EncodedBytes += uint64(encoded)
+	s.Ratio = float64(s.RawBytes) / float64(s.EncodedBytes)
+}
+
+// Snapshot returns the statistics of every algorithm used so far.
+func Snapshot() []Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	list := make([]Stats, 0, len(stats))
+	for _, s := range stats {
+		list = append(list, *s)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Algorithm < list[j].Algorithm })
+
+	return list
+}
@@ -0,0 +1,163 @@
+package compression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	text := []byte(strings.Repeat(`{"pid": 1, "name": "magnesia", "cpu": 0.5},`, 1000))
+
+	random := make([]byte, 32*1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		algorithm string
+		minSize   int
+		want      string
+	}{
+		{"no algorithm", text, "", 0, None},
+		{"none", text, None, 0, None},
+		{"gzip", text, Gzip, 0, Gzip},
+		{"zstd", text, Zstd, 0, Zstd},
+		{"below default min size", text[:1024], Zstd, 0, None},
+		{"below min size", text, Gzip, len(text) + 1, None},
+		{"at min size", text[:2000], Gzip, 2000, Gzip},
+		{"incompressible", random, Zstd, 0, None},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, algorithm, err := Encode(tt.data, tt.algorithm, tt.minSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if algorithm != tt.want {
+				t.Fatalf("algorithm = %q, want %q", algorithm, tt.want)
+			}
+			if algorithm == None && !bytes.Equal(encoded, tt.data) {
+				t.Fatal("data left alone was changed")
+			}
+			if algorithm != None && len(encoded) >= len(tt.data) {
+				t.Errorf("compressed %d bytes to %d", len(tt.data), len(encoded))
+			}
+
+			decoded, err := Decode(encoded, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, tt.data) {
+				t.Error("Decode(Encode(data)) != data")
+			}
+		})
+	}
+
+	if _, _, err := Encode(text, "brotli", 0); err == nil {
+		t.Error("Encode accepted an unknown algorithm")
+	}
+	if _, err := Decode(text, "brotli"); err == nil {
+		t.Error("Decode accepted an unknown algorithm")
+	}
+	if _, err := Decode([]byte("not gzip"), Gzip); err == nil {
+		t.Error("Decode accepted corrupt gzip")
+	}
+	if _, err := Decode([]byte("not zstd"), Zstd); err == nil {
+		t.Error("Decode accepted corrupt zstd")
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	// 128 MiB of zeros shrinks to a few KiB: a decompression bomb
+	bomb := make([]byte, 128<<20)
+
+	const limit = 1 << 20
+
+	tests := []struct {
+		name    string
+		size    int
+		limit   int
+		tooBig  bool
+		encoded func(t *testing.T, data []byte) ([]byte, string)
+	}{
+		{"gzip bomb", len(bomb), limit, true, encodeWith(Gzip)},
+		{"zstd bomb", len(bomb), limit, true, encodeWith(Zstd)},
+		{"gzip bomb under the default", len(bomb), DefaultMaxDecoded, true, encodeWith(Gzip)},
+		{"zstd bomb under the default", len(bomb), DefaultMaxDecoded, true, encodeWith(Zstd)},
+		{"gzip at the limit", limit, limit, false, encodeWith(Gzip)},
+		{"zstd at the limit", limit, limit, false, encodeWith(Zstd)},
+		{"gzip one byte over", limit + 1, limit, true, encodeWith(Gzip)},
+		{"zstd one byte over", limit + 1, limit, true, encodeWith(Zstd)},
+		{"plain over the limit", limit + 1, limit, true, encodeWith(None)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, algorithm := tt.encoded(t, bomb[:tt.size])
+
+			decoded, err := DecodeLimit(encoded, algorithm, tt.limit)
+
+			if !tt.tooBig {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(decoded) != tt.size {
+					t.Errorf("decoded %d bytes, want %d", len(decoded), tt.size)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrTooLarge) {
+				t.Fatalf("err = %v, want ErrTooLarge", err)
+			}
+			if decoded != nil {
+				t.Error("returned data along with ErrTooLarge")
+			}
+		})
+	}
+}
+
+func encodeWith(algorithm string) func(t *testing.T, data []byte) ([]byte, string) {
+	return func(t *testing.T, data []byte) ([]byte, string) {
+		t.Helper()
+
+		encoded, used, err := Encode(data, algorithm, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != algorithm {
+			t.Fatalf("Encode used %q, want %q", used, algorithm)
+		}
+		return encoded, used
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	stats = map[string]*Stats{}
+
+	text := []byte(strings.Repeat("a", 4096))
+
+	Encode(text, Gzip, 1024)
+	Encode(text[:10], Gzip, 1024)
+	Encode(text, Zstd, 1024)
+
+	snapshot := Snapshot()
+	if len(snapshot) != 2 || snapshot[0].Algorithm != Gzip || snapshot[1].Algorithm != Zstd {
+		t.Fatalf("Snapshot = %+v", snapshot)
+	}
+
+	gz := snapshot[0]
+	if gz.Compressed != 1 || gz.Skipped != 1 || gz.RawBytes != 4106 {
+		t.Errorf("gzip stats = %+v", gz)
+	}
+	if gz.Ratio <= 1 {
+		t.Errorf("gzip ratio = %f, want a saving", gz.Ratio)
+	}
+}
@@ -2,62 +2,565 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Config is the agent configuration. SchemaVersion is the layout of the
+// file and drives migrations; Version is the revision Momentum assigned.
+// Transport is how the agent talks to Momentum: "nats", or "websocket" for
+// sites that only allow HTTPS out. Commands arrive over it, and envelopes
+// go to it unless Routes sends them elsewhere.
 type Config struct {
-	Version  string `json:"version"`
-	UUID     string `json:"uuid"`
-	Momentum string `json:"server"`
-	Interval string `json:"interval"`
-	Channel  string `json:"channel"`
-	ClientID string `json:"client_id"`
+	SchemaVersion int `json:"schema_version"`
+
+	Version    string              `json:"version"`
+	UUID       string              `json:"uuid"`
+	Momentum   string              `json:"server"`
+	NATS       []string            `json:"nats,omitempty"`
+	NATSCreds  string              `json:"nats_creds,omitempty"`
+	Transport  string              `json:"transport"`
+	WebSocket  string              `json:"websocket,omitempty"`
+	Sinks      map[string]Sink     `json:"sinks,omitempty"`
+	Routes     map[string][]string `json:"routes,omitempty"`
+	Interval   Duration            `json:"interval"`
+	Schedules  map[string]Schedule `json:"schedules,omitempty"`
+	Spool      Spool               `json:"spool"`
+	Delta      Delta               `json:"delta"`
+	Channel    string              `json:"channel"`
+	ClientID   string              `json:"client_id"`
+	CommandKey string              `json:"command_key,omitempty"`
+
+	TLS            TLS            `json:"tls"`
+	Redact         Redact         `json:"redact"`
+	Privacy        Privacy        `json:"privacy"`
+	ServiceControl ServiceControl `json:"service_control"`
+	Scripts        Scripts        `json:"scripts"`
+	Update         Update         `json:"update"`
+}
+
+// Sink is one destination for envelopes. Type is "nats", "websocket",
+// "http", "file" or "stdout" and defaults to the name the sink is listed
+// under, so a second file only needs a new name. URL is where the http sink
+// posts, relative to the server unless absolute, and Path is the file sink's
+// NDJSON file. JetStream makes the nats sink wait for a stream to store
+// each envelope instead of trusting the socket.
+type Sink struct {
+	Type        string      `json:"type,omitempty"`
+	URL         string      `json:"url,omitempty"`
+	Path        string      `json:"path,omitempty"`
+	JetStream   bool        `json:"jetstream,omitempty"`
+	Compression Compression `json:"compression"`
+	Retry       Retry       `json:"retry"`
+}
+
+// Compression shrinks envelopes of at least MinSize bytes with "gzip" or
+// "zstd" before the nats, websocket or http sink sends them. An empty
+// Algorithm or "none" sends them as they are, and a MinSize of 0 means
+// 16 KiB.
+type Compression struct {
+	Algorithm string `json:"algorithm,omitempty"`
+	MinSize   int    `json:"min_size,omitempty"`
+}
+
+// Kind is the type of the sink listed under name.
+func (s Sink) Kind(name string) string {
+	if s.Type != "" {
+		return s.Type
+	}
+	return name
+}
+
+// Retry is how many times a sink tries an envelope before it gives up, or
+// spools it for NATS and the WebSocket. The wait doubles after each try.
+type Retry struct {
+	Attempts int      `json:"attempts"`
+	Backoff  Duration `json:"backoff"`
+}
+
+// SinkTypes are the kinds of sink the agent can send to.
+var SinkTypes = []string{"nats", "websocket", "http", "file", "stdout"}
+
+// Schedule overrides how often a single collector runs. An unset interval
+// follows Config.Interval and an interval of 0 disables the collector; an
+// unset jitter defaults to the interval, capped at five minutes.
+type Schedule struct {
+	Interval *Duration `json:"interval,omitempty"`
+	Jitter   *Duration `json:"jitter,omitempty"`
+}
+
+// Delta controls change-only publishing. A complete payload is sent again
+// every FullSnapshot so the server can resync.
+type Delta struct {
+	Disabled     bool     `json:"disabled,omitempty"`
+	FullSnapshot Duration `json:"full_snapshot"`
+}
+
+// TLS secures the connections to Momentum and NATS. CA is a PEM bundle
+// trusted in addition to the system roots, Cert and Key are a client
+// certificate for mTLS, and Pins are SHA-256 hashes of a server
+// SubjectPublicKeyInfo, one of which must appear in the presented chain.
+// Strict refuses to enroll or publish over plaintext.
+type TLS struct {
+	CA     string   `json:"ca,omitempty"`
+	Cert   string   `json:"cert,omitempty"`
+	Key    string   `json:"key,omitempty"`
+	Pins   []string `json:"pins,omitempty"`
+	Strict bool     `json:"strict,omitempty"`
+}
+
+// Enabled reports whether any TLS setting asks for an encrypted connection.
+func (t TLS) Enabled() bool {
+	return t.Strict || t.CA != "" || t.Cert != "" || len(t.Pins) > 0
+}
+
+func (t TLS) strict(err error) error {
+	if t.Strict {
+		return fmt.Errorf("%v (tls.strict is set)", err)
+	}
+	return err
+}
+
+// Redact removes secrets from payloads before they are published. Patterns
+// are regular expressions applied after the built-in rules; when one has a
+// capture group only the group is replaced.
+type Redact struct {
+	Disabled bool     `json:"disabled,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// Privacy selects the collection profile: "full", "standard", "minimal" or
+// one defined in Profiles, which maps payload types to field paths and
+// "collect", "hash" or "drop". Hashes are keyed with Salt, or with the
+// random key in privacy.key when it is empty.
+type Privacy struct {
+	Profile  string                                  `json:"profile"`
+	Salt     string                                  `json:"salt,omitempty"`
+	Profiles map[string]map[string]map[string]string `json:"profiles,omitempty"`
+}
+
+// ServiceControl limits which services may be started, stopped, restarted,
+// enabled or disabled. Deny wins over allow, and an empty allow list
+// permits nothing.
+type ServiceControl struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Scripts enables remote script execution. A job may ask for less than
+// MaxTimeout but never more, and at most MaxConcurrent jobs run at once.
+type Scripts struct {
+	Enabled        bool     `json:"enabled"`
+	DefaultTimeout Duration `json:"default_timeout"`
+	MaxTimeout     Duration `json:"max_timeout"`
+	MaxConcurrent  int      `json:"max_concurrent"`
+}
+
+// Update holds the base64 Ed25519 public key release binaries must be
+// signed with, and how long a new version has to report healthy before it
+// is rolled back.
+type Update struct {
+	Key   string   `json:"key,omitempty"`
+	Grace Duration `json:"grace"`
+}
+
+// Spool caps the on-disk outbox used while the transport is down. A cap of 0
+// disables it.
+type Spool struct {
+	MaxSizeMB int      `json:"max_size_mb"`
+	MaxAge    Duration `json:"max_age"`
+}
+
+// Defaults is the bottom configuration layer.
+func Defaults() Config {
+	every := func(d time.Duration) Schedule {
+		return Schedule{Interval: &Duration{d}}
+	}
+
+	return Config{
+		SchemaVersion: SchemaVersion,
+		Interval:      Duration{5 * time.Minute},
+		Transport:     "nats",
+		Sinks: map[string]Sink{
+			"nats":      {Retry: Retry{Attempts: 3, Backoff: Duration{time.Second}}},
+			"websocket": {Retry: Retry{Attempts: 3, Backoff: Duration{time.Second}}},
+			"http":      {URL: "/api/agent/data", Retry: Retry{Attempts: 5, Backoff: Duration{2 * time.Second}}},
+			"file":      {Path: filepath.Join(Dir(), "payloads.ndjson"), Retry: Retry{Attempts: 1}},
+			"stdout":    {Retry: Retry{Attempts: 1}},
+		},
+		Schedules: map[string]Schedule{
+			"services":      every(15 * time.Minute),
+			"installations": every(6 * time.Hour),
+			"power":         every(15 * time.Minute),
+		},
+		Spool:   Spool{MaxSizeMB: 64, MaxAge: Duration{7 * 24 * time.Hour}},
+		Delta:   Delta{FullSnapshot: Duration{6 * time.Hour}},
+		Scripts: Scripts{DefaultTimeout: Duration{5 * time.Minute}, MaxTimeout: Duration{time.Hour}, MaxConcurrent: 4},
+		Update:  Update{Grace: Duration{2 * time.Minute}},
+		Privacy: Privacy{Profile: "full"},
+	}
+}
+
+var (
+	resolved   *Config
+	resolvedIn string
+	resolvedMu sync.Mutex
+	reloaded   []func(Config)
+)
+
+// OnReload registers fn to run after every successful Reload, so packages
+// that keep objects built from the configuration can drop them.
+func OnReload(fn func(Config)) {
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+
+	reloaded = append(reloaded, fn)
 }
 
+// ParseConfig returns the configuration resolved from all layers. It is
+// resolved once and kept until Reload, Save or Override, so the sinks and
+// the client can call it per message. It fails when config.json does not
+// exist, since only an installed agent has one.
 func ParseConfig() (Config, error) {
-	path := Path()
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+
+	if resolved != nil && resolvedIn == Dir() {
+		return *resolved, nil
+	}
 
-	jsonData, err := os.ReadFile(path)
+	return load()
+}
+
+// Reload resolves the configuration again, for SIGHUP and the reload
+// command. An invalid configuration is reported and the previous one kept.
+func Reload() (Config, error) {
+	resolvedMu.Lock()
 
-	var config Config
+	previous, dir := resolved, resolvedIn
+
+	config, err := load()
+	if err != nil && previous != nil && dir == Dir() {
+		resolved, resolvedIn = previous, dir
+	}
+
+	hooks := append([]func(Config){}, reloaded...)
+	resolvedMu.Unlock()
 
 	if err != nil {
 		return config, err
 	}
 
-	if err := json.Unmarshal(jsonData, &config); err != nil {
+	for _, fn := range hooks {
+		fn(config)
+	}
+
+	return config, nil
+}
+
+// load resolves the layers and caches the result. Failures are not cached,
+// so an agent that is not installed yet picks up config.json once written.
+func load() (Config, error) {
+	config, _, err := Resolve()
+	if err != nil {
+		resolved = nil
 		return config, err
 	}
 
+	resolved, resolvedIn = &config, Dir()
+
 	return config, nil
 }
 
-func State() string {
-	dir := Dir()
-	switch runtime.GOOS {
-	case "windows":
-		// Prefer ProgramData
-		programData := os.Getenv("ProgramData")
-		if programData == "" {
-			programData = `C:\ProgramData`
+// forget drops the cached configuration after a layer changed.
+func forget() {
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+
+	resolved = nil
+}
+
+// Save writes c to config.json, stamped with the current schema version.
+func Save(c Config) error {
+	if err := os.MkdirAll(Dir(), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+
+	c.SchemaVersion = SchemaVersion
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %v", err)
+	}
+
+	if err := writeFile(Path(), data); err != nil {
+		return err
+	}
+
+	forget()
+
+	return nil
+}
+
+// writeFile replaces path atomically so a crash never leaves a truncated
+// config behind.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+
+	return nil
+}
+
+// Validate checks values that decode fine but cannot work. Each failure is
+// a *KeyError.
+func (c Config) Validate() error {
+	var errs []error
+
+	invalid := func(key string, err error) {
+		errs = append(errs, &KeyError{Key: key, Err: err})
+	}
+
+	httpSchemes, natsSchemes, wsSchemes := []string{"http", "https"}, []string{"nats", "tls", "ws", "wss"}, []string{"ws", "wss"}
+	if c.TLS.Strict {
+		// nats:// upgrades to TLS in-band, ws:// never does
+		httpSchemes, natsSchemes, wsSchemes = []string{"https"}, []string{"nats", "tls", "wss"}, []string{"wss"}
+	}
+
+	if c.Momentum != "" {
+		if err := checkURL(c.Momentum, httpSchemes...); err != nil {
+			invalid("server", c.TLS.strict(err))
+		}
+	}
+
+	for i, server := range c.NATS {
+		if err := checkURL(server, natsSchemes...); err != nil {
+			invalid("nats", c.TLS.strict(fmt.Errorf("entry %d: %v", i, err)))
+		}
+	}
+
+	switch c.Transport {
+	case "nats", "websocket":
+	default:
+		invalid("transport", fmt.Errorf("must be \"nats\" or \"websocket\", got %q", c.Transport))
+	}
+
+	if c.WebSocket != "" {
+		if err := checkURL(c.WebSocket, wsSchemes...); err != nil {
+			invalid("websocket", c.TLS.strict(err))
+		}
+	}
+
+	for name, sink := range c.Sinks {
+		if !slices.Contains(SinkTypes, sink.Kind(name)) {
+			invalid("sinks."+name+".type", fmt.Errorf("must be one of %s, got %q", strings.Join(SinkTypes, ", "), sink.Kind(name)))
+		}
+		switch sink.Compression.Algorithm {
+		case "", "none":
+		case "gzip", "zstd":
+			if kind := sink.Kind(name); kind == "file" || kind == "stdout" {
+				invalid("sinks."+name+".compression.algorithm", fmt.Errorf("the %s sink writes plain JSON lines and cannot compress", kind))
+			}
+		default:
+			invalid("sinks."+name+".compression.algorithm", fmt.Errorf("must be none, gzip or zstd, got %q", sink.Compression.Algorithm))
+		}
+		if sink.Compression.MinSize < 0 {
+			invalid("sinks."+name+".compression.min_size", fmt.Errorf("must not be negative"))
+		}
+		if sink.Retry.Attempts < 0 {
+			invalid("sinks."+name+".retry.attempts", fmt.Errorf("must not be negative"))
+		}
+		if sink.Kind(name) == "http" && strings.Contains(sink.URL, "://") {
+			if err := checkURL(sink.URL, httpSchemes...); err != nil {
+				invalid("sinks."+name+".url", c.TLS.strict(err))
+			}
 		}
+	}
+
+	routed := map[string]bool{c.Transport: true}
+	for payloadType, names := range c.Routes {
+		for _, name := range names {
+			if _, ok := c.Sinks[name]; !ok {
+				invalid("routes."+payloadType, fmt.Errorf("unknown sink %q", name))
+			}
+			routed[name] = true
+		}
+	}
 
-		// Create app-specific folder inside ProgramData
-		appDir := filepath.Join(programData, "Magnesia")
-		if _, err := os.Stat(appDir); os.IsNotExist(err) {
-			if err := os.MkdirAll(appDir, 0755); err != nil {
-				return filepath.Join(os.TempDir(), "magnesia_state.json") // fallback
+	for name := range routed {
+		sink, ok := c.Sinks[name]
+		if !ok {
+			continue
+		}
+		switch sink.Kind(name) {
+		case "websocket":
+			if c.WebSocketURL() == "" {
+				invalid("websocket", fmt.Errorf("no URL set and none can be derived from \"server\""))
 			}
+		case "http":
+			if sink.URL == "" || !strings.Contains(sink.URL, "://") && c.Momentum == "" {
+				invalid("sinks."+name+".url", fmt.Errorf("no URL set and no \"server\" to post to"))
+			}
+		case "file":
+			if sink.Path == "" {
+				invalid("sinks."+name+".path", fmt.Errorf("must be set"))
+			}
+		}
+	}
+
+	for i, pattern := range c.Redact.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			invalid("redact.patterns", fmt.Errorf("entry %d: %v", i, err))
 		}
-		return filepath.Join(dir, "state.json")
+	}
 
+	switch _, custom := c.Privacy.Profiles[c.Privacy.Profile]; {
+	case custom:
+	case c.Privacy.Profile == "full", c.Privacy.Profile == "standard", c.Privacy.Profile == "minimal":
 	default:
-		// Linux / Unix
-		return fmt.Sprintf("%s/state.json", dir)
+		invalid("privacy.profile", fmt.Errorf("unknown profile %q", c.Privacy.Profile))
+	}
+
+	for name, profile := range c.Privacy.Profiles {
+		for payloadType, fields := range profile {
+			for field, action := range fields {
+				if action != "collect" && action != "hash" && action != "drop" {
+					invalid("privacy.profiles."+name+"."+payloadType, fmt.Errorf("%s: action must be collect, hash or drop, got %q", field, action))
+				}
+			}
+		}
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		invalid("tls.cert", fmt.Errorf("cert and key must be set together"))
+	}
+
+	if c.Scripts.MaxConcurrent < 1 {
+		invalid("scripts.max_concurrent", fmt.Errorf("must be at least 1"))
+	}
+
+	if c.Spool.MaxSizeMB < 0 {
+		invalid("spool.max_size_mb", fmt.Errorf("must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkURL(raw string, schemes ...string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%q must use one of %s://", raw, strings.Join(schemes, "://, "))
+}
+
+// State is where the last published payload of one type is kept, so each
+// payload type is diffed only against its own history.
+func State(payloadType string) string {
+	return filepath.Join(Dir(), "state", payloadType+".json")
+}
+
+// Sequence holds the number of the last envelope sent.
+func Sequence() string {
+	return filepath.Join(Dir(), "state", "sequence")
+}
+
+// Commands holds the IDs of executed remote commands until they expire.
+func Commands() string {
+	return filepath.Join(Dir(), "state", "commands")
+}
+
+// SpoolDir holds envelopes waiting for the transport to come back.
+func SpoolDir() string {
+	return filepath.Join(Dir(), "spool")
+}
+
+// NATSServers returns the configured NATS URLs, or the Momentum host on the
+// default NATS port when none are set.
+func (c Config) NATSServers() []string {
+	if len(c.NATS) > 0 {
+		return c.NATS
+	}
+
+	u, err := url.Parse(c.Momentum)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+
+	return []string{"nats://" + net.JoinHostPort(u.Hostname(), "4222")}
+}
+
+// WebSocketURL returns the configured WebSocket endpoint, or the agent
+// endpoint on the Momentum host, which shares its port and TLS with the
+// HTTP API.
+func (c Config) WebSocketURL() string {
+	if c.WebSocket != "" {
+		return c.WebSocket
+	}
+
+	u, err := url.Parse(c.Momentum)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	scheme := "wss"
+	if u.Scheme == "http" {
+		scheme = "ws"
 	}
+
+	return scheme + "://" + u.Host + "/api/agent/ws"
+}
+
+// Public is c without the privacy salt, which is as secret as the key
+// and must not be shown or sent back to the server.
+func (c Config) Public() Config {
+	c.Privacy.Salt = ""
+	return c
+}
+
+// Route lists the sinks payloadType is sent to: its own entry in Routes,
+// else the "*" entry, else the transport.
+func (c Config) Route(payloadType string) []string {
+	if names, ok := c.Routes[payloadType]; ok {
+		return names
+	}
+	if names, ok := c.Routes["*"]; ok {
+		return names
+	}
+	return []string{c.Transport}
+}
+
+// ConfDir holds drop-in files applied on top of config.json in name order.
+func ConfDir() string {
+	return filepath.Join(Dir(), "conf.d")
 }
 
 func Path() string {
@@ -78,7 +581,13 @@ func Path() string {
 	}
 }
 
+// Dir holds everything the agent keeps on disk. MAGNESIA_DIR moves it, e.g.
+// to run an unprivileged copy of the agent or its tests.
 func Dir() string {
+	if dir := os.Getenv(envPrefix + "DIR"); dir != "" {
+		return dir
+	}
+
 	switch runtime.GOOS {
 	case "windows":
 		// Prefer ProgramData
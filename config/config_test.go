@@ -0,0 +1,89 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseConfigIsCached(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	if _, err := ParseConfig(); err == nil {
+		t.Fatal("ParseConfig succeeded without config.json")
+	}
+
+	first := Defaults()
+	first.UUID = "first"
+	if err := Save(first); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ParseConfig()
+	if err != nil || cfg.UUID != "first" {
+		t.Fatalf("after Save: uuid = %q, err = %v", cfg.UUID, err)
+	}
+
+	// an edit on disk waits for Reload
+	edit := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(Path(), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edit(`{"uuid": "second"}`)
+	if cfg, _ := ParseConfig(); cfg.UUID != "first" {
+		t.Errorf("ParseConfig reread the file: uuid = %q", cfg.UUID)
+	}
+
+	if cfg, err := Reload(); err != nil || cfg.UUID != "second" {
+		t.Fatalf("Reload: uuid = %q, err = %v", cfg.UUID, err)
+	}
+	if cfg, _ := ParseConfig(); cfg.UUID != "second" {
+		t.Errorf("after Reload: uuid = %q", cfg.UUID)
+	}
+
+	// a broken edit keeps the previous configuration
+	edit(`{"uuid": `)
+	if _, err := Reload(); err == nil {
+		t.Fatal("Reload accepted invalid JSON")
+	}
+	if cfg, err := ParseConfig(); err != nil || cfg.UUID != "second" {
+		t.Errorf("after a failed Reload: uuid = %q, err = %v", cfg.UUID, err)
+	}
+
+	// another directory is resolved on its own
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+	if _, err := ParseConfig(); err == nil {
+		t.Error("ParseConfig served the cache of another directory")
+	}
+}
+
+func TestReloadRunsHooks(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	cfg := Defaults()
+	cfg.UUID = "a"
+	if err := Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	OnReload(func(c Config) { got = append(got, c.UUID) })
+	t.Cleanup(func() { reloaded = reloaded[:len(reloaded)-1] })
+
+	if _, err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(Path(), []byte(`{"uuid": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Reload(); err == nil {
+		t.Fatal("Reload accepted invalid JSON")
+	}
+
+	if len(got) != 1 || got[0] != "a" {
+		t.Errorf("hooks saw %v, want one successful reload", got)
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration read from a Go duration string ("90s", "6h")
+// or a number of seconds, given either as a JSON number or a string.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		return d.set(time.Duration(seconds * float64(time.Second)))
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("expected a duration such as \"5m\", got %s", string(data))
+	}
+
+	return d.Set(value)
+}
+
+// Set parses value the same way as UnmarshalJSON does. An empty value
+// leaves d unchanged.
+func (d *Duration) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return d.set(time.Duration(seconds) * time.Second)
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("expected a duration such as \"5m\", got %q", value)
+	}
+
+	return d.set(parsed)
+}
+
+func (d *Duration) set(value time.Duration) error {
+	if value < 0 {
+		return fmt.Errorf("duration must not be negative, got %s", value)
+	}
+
+	d.Duration = value
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeyError is a configuration value that could not be used. Source is the
+// layer it came from, "path:line" when it was read from a file.
+type KeyError struct {
+	Key    string
+	Source string
+	Err    error
+}
+
+func (e *KeyError) Error() string {
+	switch {
+	case e.Source == "" || e.Source == "default":
+		return fmt.Sprintf("%s: %v", e.Key, e.Err)
+	case strings.HasPrefix(e.Source, "env ") || strings.HasPrefix(e.Source, "flag "):
+		return fmt.Sprintf("%s (%s): %v", e.Key, e.Source, e.Err)
+	default:
+		return fmt.Sprintf("%s: %s: %v", e.Source, e.Key, e.Err)
+	}
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// locate fills in where each failing key of a Validate error was set.
+func locate(err error, sources Sources) error {
+	if err == nil {
+		return nil
+	}
+
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	} else {
+		errs = []error{err}
+	}
+
+	for _, e := range errs {
+		var keyErr *KeyError
+		if errors.As(e, &keyErr) && keyErr.Source == "" {
+			keyErr.Source = sourceOf(sources, keyErr.Key)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// syntaxError turns a JSON parse failure into "path:line: message".
+func syntaxError(path string, data []byte, err error) error {
+	var offset int64 = -1
+
+	var syntax *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntax):
+		offset = syntax.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+		err = fmt.Errorf("expected an object, got %s", typeErr.Value)
+	}
+
+	if offset < 0 {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return fmt.Errorf("%s:%d: %v", path, lineAt(data, offset), err)
+}
+
+// keyLines maps the dotted path of every object key in data to the line it
+// is on. Keys inside arrays are not addressable and are left out.
+func keyLines(data []byte) map[string]int {
+	type frame struct {
+		object bool
+		key    string
+		path   string
+	}
+
+	lines := map[string]int{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	var stack []frame
+	expectKey := false
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return lines
+		}
+
+		var top *frame
+		if len(stack) > 0 {
+			top = &stack[len(stack)-1]
+		}
+
+		if top != nil && top.object && expectKey {
+			if key, ok := tok.(string); ok {
+				top.key = key
+				if top.path != "-" {
+					lines[join(top.path, key)] = lineAt(data, dec.InputOffset())
+				}
+				expectKey = false
+				continue
+			}
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			path := ""
+			if top != nil {
+				path = "-"
+				if top.object && top.path != "-" {
+					path = join(top.path, top.key)
+				}
+			}
+			stack = append(stack, frame{object: tok == json.Delim('{'), path: path})
+			expectKey = tok == json.Delim('{')
+
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			expectKey = len(stack) > 0 && stack[len(stack)-1].object
+
+		default:
+			expectKey = top != nil && top.object
+		}
+	}
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/auh-xda/magnesia/console"
+)
+
+// SchemaVersion is the layout of config.json written by this agent. Bump it
+// together with a new entry in migrations whenever a key is renamed, moved
+// or changes type.
+const SchemaVersion = 1
+
+// migrations[n] upgrades a file from schema n to n+1 in place.
+var migrations = []func(layer map[string]any){
+	// 0: files written before schema_version existed. Intervals were plain
+	// strings where "" meant "use the default"; durations are typed now, so
+	// drop the empty ones instead of carrying them forward.
+	func(layer map[string]any) {
+		dropEmpty(layer, "interval")
+
+		if schedules, ok := layer["schedules"].(map[string]any); ok {
+			for _, s := range schedules {
+				if schedule, ok := s.(map[string]any); ok {
+					dropEmpty(schedule, "interval")
+					dropEmpty(schedule, "jitter")
+				}
+			}
+		}
+
+		for section, keys := range map[string][]string{
+			"spool":   {"max_age"},
+			"delta":   {"full_snapshot"},
+			"scripts": {"default_timeout", "max_timeout"},
+			"update":  {"grace"},
+		} {
+			if m, ok := layer[section].(map[string]any); ok {
+				for _, key := range keys {
+					dropEmpty(m, key)
+				}
+			}
+		}
+	},
+}
+
+// migrate upgrades layer to SchemaVersion. When persist is set the original
+// file is first copied to <path>.v<n>.bak and then rewritten. It returns the
+// content on disk, for line lookups.
+func migrate(path string, data []byte, layer map[string]any, persist bool) ([]byte, error) {
+	from := 0
+	if v, ok := layer["schema_version"]; ok {
+		n, ok := v.(float64)
+		if !ok || n < 0 || n != float64(int(n)) {
+			return nil, &KeyError{Key: "schema_version", Source: fileOrigin(path, keyLines(data))("schema_version"), Err: fmt.Errorf("expected a whole number, got %v", v)}
+		}
+		from = int(n)
+	}
+
+	if from > SchemaVersion {
+		return nil, fmt.Errorf("%s: schema_version %d is newer than this agent supports (%d), update the agent", path, from, SchemaVersion)
+	}
+
+	if from == SchemaVersion {
+		return data, nil
+	}
+
+	for v := from; v < SchemaVersion; v++ {
+		migrations[v](layer)
+	}
+	layer["schema_version"] = SchemaVersion
+
+	migrated, err := json.MarshalIndent(layer, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal migrated config: %v", err)
+	}
+
+	if !persist {
+		return data, nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", path, from)
+
+	if err := os.WriteFile(backup, data, 0600); err != nil {
+		console.Warn(fmt.Sprintf("Config schema %d is outdated but cannot be upgraded on disk: %v", from, err))
+		return data, nil
+	}
+
+	if err := writeFile(path, migrated); err != nil {
+		console.Warn(fmt.Sprintf("Config schema %d is outdated but cannot be upgraded on disk: %v", from, err))
+		return data, nil
+	}
+
+	console.Info(fmt.Sprintf("Upgraded %s from schema %d to %d, original saved as %s", path, from, SchemaVersion, backup))
+
+	return migrated, nil
+}
+
+func dropEmpty(m map[string]any, key string) {
+	if s, ok := m[key].(string); ok && s == "" {
+		delete(m, key)
+	}
+}
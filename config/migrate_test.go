@@ -0,0 +1,133 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		layer   string
+		dropped []string // dotted keys the migration removes
+		kept    []string
+	}{
+		{
+			name:    "empty durations from schema 0",
+			layer:   `{"interval": "", "spool": {"max_age": "", "max_size_mb": 8}, "delta": {"full_snapshot": ""}, "scripts": {"default_timeout": "", "max_timeout": "1h"}, "update": {"grace": ""}}`,
+			dropped: []string{"interval", "spool.max_age", "delta.full_snapshot", "scripts.default_timeout", "update.grace"},
+			kept:    []string{"spool.max_size_mb", "scripts.max_timeout"},
+		},
+		{
+			name:    "empty schedule intervals",
+			layer:   `{"schedules": {"power": {"interval": "", "jitter": ""}, "services": {"interval": "1h", "jitter": "1m"}}}`,
+			dropped: []string{"schedules.power.interval", "schedules.power.jitter"},
+			kept:    []string{"schedules.services.interval", "schedules.services.jitter"},
+		},
+		{
+			name:  "set values are left alone",
+			layer: `{"interval": "90s", "spool": {"max_age": "1h"}}`,
+			kept:  []string{"interval", "spool.max_age"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layer := map[string]any{}
+			if err := json.Unmarshal([]byte(tt.layer), &layer); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := migrate("test.json", []byte(tt.layer), layer, false); err != nil {
+				t.Fatal(err)
+			}
+
+			if layer["schema_version"] != SchemaVersion {
+				t.Errorf("schema_version = %v, want %d", layer["schema_version"], SchemaVersion)
+			}
+			for _, key := range tt.dropped {
+				if _, ok := lookup(layer, key); ok {
+					t.Errorf("%s was kept", key)
+				}
+			}
+			for _, key := range tt.kept {
+				if _, ok := lookup(layer, key); !ok {
+					t.Errorf("%s was dropped", key)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateConfigFile(t *testing.T) {
+	setup(t, `{"uuid": "a", "interval": ""}`, map[string]string{
+		"10-local.json": `{"spool": {"max_age": ""}}`,
+	}, nil)
+
+	original, _ := os.ReadFile(Path())
+	dropIn := filepath.Join(ConfDir(), "10-local.json")
+
+	config, _, err := Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interval != Defaults().Interval {
+		t.Errorf("interval = %s, want the default", config.Interval)
+	}
+
+	// config.json is upgraded on disk after a backup
+	backup, err := os.ReadFile(Path() + ".v0.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != string(original) {
+		t.Errorf("backup = %s, want the original %s", backup, original)
+	}
+
+	var upgraded map[string]any
+	content, _ := os.ReadFile(Path())
+	if err := json.Unmarshal(content, &upgraded); err != nil {
+		t.Fatal(err)
+	}
+	if upgraded["schema_version"] != float64(SchemaVersion) {
+		t.Errorf("config.json schema_version = %v", upgraded["schema_version"])
+	}
+	if _, ok := upgraded["interval"]; ok {
+		t.Error("config.json still has the empty interval")
+	}
+
+	// drop-ins belong to configuration management and stay as written
+	if content, _ := os.ReadFile(dropIn); !strings.Contains(string(content), `"max_age": ""`) {
+		t.Errorf("drop-in was rewritten to %s", content)
+	}
+	if _, err := os.Stat(dropIn + ".v0.bak"); !os.IsNotExist(err) {
+		t.Error("drop-in was backed up")
+	}
+
+	// an upgraded file is not migrated again
+	if _, _, err := Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(Path() + ".v*.bak"); len(matches) != 1 {
+		t.Errorf("backups = %v, want one", matches)
+	}
+}
+
+func lookup(layer map[string]any, key string) (any, bool) {
+	var node any = layer
+
+	for _, part := range strings.Split(key, ".") {
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if node, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+
+	return node, true
+}
@@ -0,0 +1,557 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const envPrefix = "MAGNESIA_"
+
+// Sources maps a dotted key such as "spool.max_age" to the layer that set
+// it: "default", "path:line", "env MAGNESIA_…" or "flag -…".
+type Sources map[string]string
+
+// origin names the source of one key within a layer.
+type origin func(key string) string
+
+func constant(source string) origin {
+	return func(string) string { return source }
+}
+
+func fileOrigin(path string, lines map[string]int) origin {
+	return func(key string) string {
+		for k := key; k != ""; k = parent(k) {
+			if line, ok := lines[k]; ok {
+				return fmt.Sprintf("%s:%d", path, line)
+			}
+		}
+		return path
+	}
+}
+
+// Setting is one resolved value and where it came from.
+type Setting struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+type override struct {
+	key    string
+	value  string
+	source string
+}
+
+var (
+	overrides   []override
+	overridesMu sync.Mutex
+)
+
+// Override sets key from a command line flag. Flags are the top layer and
+// win over files and environment variables.
+func Override(key, value, flag string) {
+	overridesMu.Lock()
+	overrides = append(overrides, override{key: key, value: value, source: "flag -" + flag})
+	overridesMu.Unlock()
+
+	forget()
+}
+
+// Resolve merges, from lowest to highest precedence, the defaults,
+// config.json, the drop-ins in conf.d, MAGNESIA_* environment variables and
+// flags, then decodes and validates the result.
+func Resolve() (Config, Sources, error) {
+	return resolve(true)
+}
+
+// Bootstrap resolves every layer but does not require config.json, for
+// settings such as TLS that install needs before the file is written.
+func Bootstrap() (Config, error) {
+	config, _, err := resolve(false)
+
+	return config, err
+}
+
+func resolve(installed bool) (Config, Sources, error) {
+	config := Defaults()
+
+	sources := Sources{}
+
+	tree, err := toTree(Defaults())
+	if err != nil {
+		return config, sources, err
+	}
+	mark(tree, "", constant("default"), sources)
+
+	paths, _ := filepath.Glob(filepath.Join(ConfDir(), "*.json"))
+	sort.Strings(paths)
+
+	for i, path := range append([]string{Path()}, paths...) {
+		layer, lines, err := readLayer(path, i == 0)
+		if i == 0 && !installed && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return config, sources, err
+		}
+		merge(tree, layer, "", fileOrigin(path, lines), sources)
+	}
+
+	leaves := leafTypes(reflect.TypeOf(config), "")
+
+	for _, key := range sortedLeaves(leaves) {
+		name := EnvName(key)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := set(tree, key, value, leaves[key], "env "+name, sources); err != nil {
+				return config, sources, err
+			}
+		}
+	}
+
+	overridesMu.Lock()
+	applied := append([]override(nil), overrides...)
+	overridesMu.Unlock()
+
+	for _, o := range applied {
+		t, ok := leaves[o.key]
+		if !ok {
+			return config, sources, fmt.Errorf("%s: unknown configuration key %q", o.source, o.key)
+		}
+		if err := set(tree, o.key, o.value, t, o.source, sources); err != nil {
+			return config, sources, err
+		}
+	}
+
+	if err := decode(reflect.ValueOf(&config).Elem(), tree, "", sources); err != nil {
+		return config, sources, err
+	}
+
+	return config, sources, locate(config.Validate(), sources)
+}
+
+// Enrolled decodes the configuration Momentum returns at enrollment on top
+// of the defaults. Keys it leaves out, sends as null or as an empty string
+// keep their default, so the config.json written from it resolves.
+func Enrolled(data []byte) (Config, error) {
+	config := Defaults()
+
+	tree, err := toTree(config)
+	if err != nil {
+		return config, err
+	}
+
+	layer := map[string]any{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &layer); err != nil {
+			return config, fmt.Errorf("failed to parse configuration from Momentum: %v", err)
+		}
+	}
+
+	if _, err := migrate("enrollment", data, layer, false); err != nil {
+		return config, err
+	}
+	dropUnset(layer)
+
+	sources := Sources{}
+	merge(tree, layer, "", constant("enrollment"), sources)
+
+	if err := decode(reflect.ValueOf(&config).Elem(), tree, "", sources); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// dropUnset removes null and empty string values from layer, at any depth.
+func dropUnset(layer map[string]any) {
+	for k, v := range layer {
+		switch v := v.(type) {
+		case nil:
+			delete(layer, k)
+		case string:
+			if v == "" {
+				delete(layer, k)
+			}
+		case map[string]any:
+			dropUnset(v)
+		}
+	}
+}
+
+// Effective lists every resolved value with the layer it came from.
+func Effective() ([]Setting, error) {
+	config, sources, err := Resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := toTree(config.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	flat := map[string]any{}
+	flatten(tree, "", flat)
+
+	// fields left out by omitempty are still settable, list them empty
+	for key, t := range leafTypes(reflect.TypeOf(config), "") {
+		if _, ok := flat[key]; !ok && !hasChild(flat, key) {
+			flat[key] = reflect.Zero(t).Interface()
+		}
+	}
+
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	settings := make([]Setting, 0, len(keys))
+
+	for _, key := range keys {
+		value := ""
+		if s, ok := flat[key].(string); ok {
+			value = s
+		} else if v := reflect.ValueOf(flat[key]); (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil() {
+			value = ""
+		} else {
+			b, _ := json.Marshal(flat[key])
+			value = string(b)
+		}
+
+		settings = append(settings, Setting{Key: key, Value: value, Source: sourceOf(sources, key)})
+	}
+
+	return settings, nil
+}
+
+// EnvName is the environment variable that sets key, e.g. spool.max_age is
+// MAGNESIA_SPOOL_MAX_AGE.
+func EnvName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// sourceOf finds the layer of key, or of the closest parent that was set
+// as a whole, such as a list or a map.
+func sourceOf(sources Sources, key string) string {
+	for k := key; k != ""; k = parent(k) {
+		if source, ok := sources[k]; ok {
+			return source
+		}
+	}
+	return "default"
+}
+
+func parent(key string) string {
+	i := strings.LastIndex(key, ".")
+	if i < 0 {
+		return ""
+	}
+	return key[:i]
+}
+
+func hasChild(flat map[string]any, key string) bool {
+	for k := range flat {
+		if strings.HasPrefix(k, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// readLayer loads one configuration file, upgrading it to the current
+// schema first, and returns it with the line of every key. Only
+// config.json is rewritten by a migration; drop-ins are upgraded in memory
+// since they usually belong to configuration management.
+func readLayer(path string, persist bool) (map[string]any, map[string]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	layer := map[string]any{}
+	if err := json.Unmarshal(data, &layer); err != nil {
+		return nil, nil, syntaxError(path, data, err)
+	}
+
+	if data, err = migrate(path, data, layer, persist); err != nil {
+		return nil, nil, err
+	}
+
+	return layer, keyLines(data), nil
+}
+
+func toTree(v any) (map[string]any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := map[string]any{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// merge deep-merges objects from layer into tree; anything else replaces
+// what was there.
+func merge(tree, layer map[string]any, prefix string, source origin, sources Sources) {
+	for k, v := range layer {
+		key := join(prefix, k)
+
+		sub, isMap := v.(map[string]any)
+		base, baseIsMap := tree[k].(map[string]any)
+
+		if isMap && baseIsMap {
+			merge(base, sub, key, source, sources)
+			continue
+		}
+
+		unmark(sources, key)
+		tree[k] = v
+		mark(v, key, source, sources)
+	}
+}
+
+func mark(v any, key string, source origin, sources Sources) {
+	if m, ok := v.(map[string]any); ok && len(m) > 0 {
+		for k, sub := range m {
+			mark(sub, join(key, k), source, sources)
+		}
+		return
+	}
+	sources[key] = source(key)
+}
+
+func unmark(sources Sources, key string) {
+	for k := range sources {
+		if k == key || strings.HasPrefix(k, key+".") {
+			delete(sources, k)
+		}
+	}
+}
+
+func flatten(v any, key string, out map[string]any) {
+	if m, ok := v.(map[string]any); ok {
+		for k, sub := range m {
+			flatten(sub, join(key, k), out)
+		}
+		return
+	}
+	out[key] = v
+}
+
+// set converts a string from the environment or a flag to the JSON shape
+// of its field and stores it at key.
+func set(tree map[string]any, key, raw string, t reflect.Type, source string, sources Sources) error {
+	value, err := convert(raw, t)
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+
+	parts := strings.Split(key, ".")
+	node := tree
+
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := node[part].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			node[part] = next
+		}
+		node = next
+	}
+
+	unmark(sources, key)
+	node[parts[len(parts)-1]] = value
+	mark(value, key, constant(source), sources)
+
+	return nil
+}
+
+func convert(raw string, t reflect.Type) (any, error) {
+	switch {
+	case t == reflect.TypeOf(Duration{}):
+		if strings.TrimSpace(raw) == "" {
+			return "", nil
+		}
+		var d Duration
+		if err := d.Set(raw); err != nil {
+			return nil, err
+		}
+		return d.String(), nil
+
+	case t.Kind() == reflect.String:
+		return raw, nil
+
+	case t.Kind() == reflect.Bool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("expected true or false, got %q", raw)
+		}
+		return value, nil
+
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("expected a whole number, got %q", raw)
+		}
+		return value, nil
+
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		items := []any{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+
+	default:
+		var value any
+		if err := json.Unmarshal([]byte(raw), &value); err != nil {
+			return nil, fmt.Errorf("expected JSON, %v", err)
+		}
+		return value, nil
+	}
+}
+
+// leafTypes lists the settable keys of a config struct: every field except
+// nested structs, which are walked instead.
+func leafTypes(t reflect.Type, prefix string) map[string]reflect.Type {
+	leaves := map[string]reflect.Type{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonName(field)
+		if name == "" {
+			continue
+		}
+
+		key := join(prefix, name)
+
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(Duration{}) {
+			for k, v := range leafTypes(field.Type, key) {
+				leaves[k] = v
+			}
+			continue
+		}
+
+		leaves[key] = field.Type
+	}
+
+	return leaves
+}
+
+func sortedLeaves(leaves map[string]reflect.Type) []string {
+	keys := make([]string, 0, len(leaves))
+	for k := range leaves {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// decode fills v from tree field by field, so a bad value is reported with
+// its key and the layer it came from. Empty durations keep the value
+// already in v.
+func decode(v reflect.Value, tree map[string]any, prefix string, sources Sources) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonName(field)
+		if name == "" {
+			continue
+		}
+
+		raw, ok := tree[name]
+		if !ok {
+			continue
+		}
+
+		key := join(prefix, name)
+
+		if sub, isMap := raw.(map[string]any); isMap && field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(Duration{}) {
+			if err := decode(v.Field(i), sub, key, sources); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if sub, isMap := raw.(map[string]any); isMap && field.Type.Kind() == reflect.Map && field.Type.Elem().Kind() == reflect.Struct {
+			entries := reflect.MakeMapWithSize(field.Type, len(sub))
+			for k, entry := range sub {
+				object, ok := entry.(map[string]any)
+				if !ok {
+					return &KeyError{Key: join(key, k), Source: sourceOf(sources, join(key, k)), Err: fmt.Errorf("expected an object")}
+				}
+				elem := reflect.New(field.Type.Elem()).Elem()
+				if err := decode(elem, object, join(key, k), sources); err != nil {
+					return err
+				}
+				entries.SetMapIndex(reflect.ValueOf(k), elem)
+			}
+			v.Field(i).Set(entries)
+			continue
+		}
+
+		data, _ := json.Marshal(raw)
+		if err := json.Unmarshal(data, v.Field(i).Addr().Interface()); err != nil {
+			return &KeyError{Key: key, Source: sourceOf(sources, key), Err: unwrap(err)}
+		}
+	}
+
+	return nil
+}
+
+// unwrap trims the Go type names encoding/json puts in its messages.
+func unwrap(err error) error {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return fmt.Errorf("expected %s, got %s", kindName(typeErr.Type), typeErr.Value)
+	}
+	return err
+}
+
+func kindName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "a whole number"
+	case reflect.Slice:
+		return "a list"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	default:
+		return "a " + t.Kind().String()
+	}
+}
+
+func jsonName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	name := strings.Split(tag, ",")[0]
+
+	if name == "-" || !field.IsExported() {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
@@ -0,0 +1,294 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setup writes config.json, when given, and the drop-ins into a fresh
+// config directory, sets env and clears the flag overrides. A config.json
+// without schema_version is migrated and rewritten, which moves its lines.
+func setup(t *testing.T, configJSON string, dropIns map[string]string, env map[string]string) {
+	t.Helper()
+
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	overridesMu.Lock()
+	overrides = nil
+	overridesMu.Unlock()
+	t.Cleanup(func() {
+		overridesMu.Lock()
+		overrides = nil
+		overridesMu.Unlock()
+	})
+
+	if configJSON != "" {
+		if err := os.WriteFile(Path(), []byte(configJSON), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(dropIns) > 0 {
+		if err := os.MkdirAll(ConfDir(), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range dropIns {
+		if err := os.WriteFile(filepath.Join(ConfDir(), name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+}
+
+func TestResolveLayers(t *testing.T) {
+	tests := []struct {
+		name       string
+		configJSON string
+		dropIns    map[string]string
+		env        map[string]string
+		flags      [][3]string
+		key        string
+		source     string // suffix of the source of key
+		check      func(c Config) bool
+	}{
+		{
+			name:       "defaults",
+			configJSON: `{"uuid": "a"}`,
+			key:        "spool.max_age", source: "default",
+			check: func(c Config) bool { return c.Spool.MaxAge.Duration == 7*24*time.Hour },
+		},
+		{
+			name:       "config.json",
+			configJSON: "{\n  \"schema_version\": 1,\n  \"uuid\": \"a\",\n  \"interval\": \"90s\"\n}",
+			key:        "interval", source: "config.json:4",
+			check: func(c Config) bool { return c.Interval.Duration == 90*time.Second },
+		},
+		{
+			name:       "duration in seconds",
+			configJSON: `{"schema_version": 1, "uuid": "a", "interval": 120}`,
+			key:        "interval", source: "config.json:1",
+			check: func(c Config) bool { return c.Interval.Duration == 2*time.Minute },
+		},
+		{
+			name:       "drop-ins in name order",
+			configJSON: `{"uuid": "a", "interval": "90s"}`,
+			dropIns: map[string]string{
+				"20-late.json":  `{"interval": "3m"}`,
+				"10-early.json": `{"interval": "2m"}`,
+			},
+			key: "interval", source: "20-late.json:1",
+			check: func(c Config) bool { return c.Interval.Duration == 3*time.Minute },
+		},
+		{
+			name:       "drop-ins merge objects key by key",
+			configJSON: `{"schema_version": 1, "uuid": "a", "spool": {"max_size_mb": 10}}`,
+			dropIns:    map[string]string{"10-spool.json": `{"spool": {"max_age": "1h"}}`},
+			key:        "spool.max_size_mb", source: "config.json:1",
+			check: func(c Config) bool { return c.Spool.MaxSizeMB == 10 && c.Spool.MaxAge.Duration == time.Hour },
+		},
+		{
+			name:       "environment over drop-ins",
+			configJSON: `{"uuid": "a"}`,
+			dropIns:    map[string]string{"10-local.json": `{"interval": "2m"}`},
+			env:        map[string]string{"MAGNESIA_INTERVAL": "4m"},
+			key:        "interval", source: "env MAGNESIA_INTERVAL",
+			check: func(c Config) bool { return c.Interval.Duration == 4*time.Minute },
+		},
+		{
+			name:       "environment list",
+			configJSON: `{"uuid": "a"}`,
+			env:        map[string]string{"MAGNESIA_NATS": "nats://a:4222, nats://b:4222"},
+			key:        "nats", source: "env MAGNESIA_NATS",
+			check: func(c Config) bool {
+				return len(c.NATS) == 2 && c.NATS[0] == "nats://a:4222" && c.NATS[1] == "nats://b:4222"
+			},
+		},
+		{
+			name:       "environment nested key",
+			configJSON: `{"uuid": "a"}`,
+			env:        map[string]string{"MAGNESIA_SPOOL_MAX_AGE": "48h"},
+			key:        "spool.max_age", source: "env MAGNESIA_SPOOL_MAX_AGE",
+			check: func(c Config) bool { return c.Spool.MaxAge.Duration == 48*time.Hour },
+		},
+		{
+			name:       "flags over environment",
+			configJSON: `{"uuid": "a"}`,
+			env:        map[string]string{"MAGNESIA_INTERVAL": "4m"},
+			flags:      [][3]string{{"interval", "5m", "interval"}},
+			key:        "interval", source: "flag -interval",
+			check: func(c Config) bool { return c.Interval.Duration == 5*time.Minute },
+		},
+		{
+			name:       "flag sets a nested key",
+			configJSON: `{"uuid": "a"}`,
+			flags:      [][3]string{{"tls.strict", "true", "tls_strict"}},
+			key:        "tls.strict", source: "flag -tls_strict",
+			check: func(c Config) bool { return c.TLS.Strict },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, tt.configJSON, tt.dropIns, tt.env)
+			for _, f := range tt.flags {
+				Override(f[0], f[1], f[2])
+			}
+
+			config, sources, err := Resolve()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.check(config) {
+				t.Errorf("resolved %+v", config)
+			}
+			if source := sourceOf(sources, tt.key); !strings.HasSuffix(source, tt.source) {
+				t.Errorf("source of %s = %q, want …%s", tt.key, source, tt.source)
+			}
+		})
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		configJSON string
+		dropIns    map[string]string
+		env        map[string]string
+		flags      [][3]string
+		wantErr    []string
+	}{
+		{
+			name:    "no config.json",
+			wantErr: []string{"config.json"},
+		},
+		{
+			name:       "invalid JSON",
+			configJSON: "{\n  \"uuid\": \n}",
+			wantErr:    []string{"config.json:3"},
+		},
+		{
+			name:       "bad duration in a drop-in",
+			configJSON: `{"uuid": "a"}`,
+			dropIns:    map[string]string{"10-local.json": "{\n  \"spool\": {\n    \"max_age\": \"forever\"\n  }\n}"},
+			wantErr:    []string{"10-local.json:3", "spool.max_age"},
+		},
+		{
+			name:       "wrong type",
+			configJSON: `{"schema_version": 1, "uuid": "a", "spool": {"max_size_mb": "big"}}`,
+			wantErr:    []string{"config.json:1", "spool.max_size_mb", "expected"},
+		},
+		{
+			name:       "bad environment value",
+			configJSON: `{"uuid": "a"}`,
+			env:        map[string]string{"MAGNESIA_TLS_STRICT": "maybe"},
+			wantErr:    []string{"env MAGNESIA_TLS_STRICT", "true or false"},
+		},
+		{
+			name:       "invalid value reported with its layer",
+			configJSON: `{"uuid": "a"}`,
+			env:        map[string]string{"MAGNESIA_TRANSPORT": "carrier-pigeon"},
+			wantErr:    []string{"transport", "env MAGNESIA_TRANSPORT"},
+		},
+		{
+			name:       "plaintext server in strict mode",
+			configJSON: `{"uuid": "a", "server": "http://momentum.example.com", "tls": {"strict": true}}`,
+			wantErr:    []string{"server", "tls.strict is set"},
+		},
+		{
+			name:       "plaintext websocket in strict mode",
+			configJSON: `{"uuid": "a", "websocket": "ws://momentum.example.com/ws"}`,
+			env:        map[string]string{"MAGNESIA_TLS_STRICT": "true"},
+			wantErr:    []string{"websocket", "tls.strict is set"},
+		},
+		{
+			name:       "unknown flag key",
+			configJSON: `{"uuid": "a"}`,
+			flags:      [][3]string{{"no.such.key", "1", "nope"}},
+			wantErr:    []string{"flag -nope", "unknown configuration key"},
+		},
+		{
+			name:       "schema newer than the agent",
+			configJSON: `{"uuid": "a", "schema_version": 99}`,
+			wantErr:    []string{"newer than this agent"},
+		},
+		{
+			name:       "schema version not a number",
+			configJSON: `{"uuid": "a", "schema_version": "one"}`,
+			wantErr:    []string{"schema_version", "whole number"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, tt.configJSON, tt.dropIns, tt.env)
+			for _, f := range tt.flags {
+				Override(f[0], f[1], f[2])
+			}
+
+			_, _, err := Resolve()
+			if err == nil {
+				t.Fatal("Resolve succeeded")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBootstrapWithoutConfigFile(t *testing.T) {
+	setup(t, "", nil, map[string]string{"MAGNESIA_TLS_CA": "/etc/ssl/ca.pem"})
+
+	config, err := Bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TLS.CA != "/etc/ssl/ca.pem" {
+		t.Errorf("tls.ca = %q", config.TLS.CA)
+	}
+}
+
+func TestEffective(t *testing.T) {
+	setup(t, `{"schema_version": 1, "uuid": "a", "interval": "90s", "privacy": {"salt": "s3cr3t"}}`, nil, map[string]string{"MAGNESIA_CHANNEL": "agents"})
+
+	settings, err := Effective()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][2]string{
+		"interval":      {"1m30s", "config.json:1"},
+		"channel":       {"agents", "env MAGNESIA_CHANNEL"},
+		"spool.max_age": {"168h0m0s", "default"},
+		"privacy.salt":  {"", "config.json:1"},
+	}
+
+	for _, s := range settings {
+		w, ok := want[s.Key]
+		if !ok {
+			continue
+		}
+		delete(want, s.Key)
+
+		if s.Value != w[0] && s.Value != `"`+w[0]+`"` {
+			t.Errorf("%s = %s, want %s", s.Key, s.Value, w[0])
+		}
+		if !strings.HasSuffix(s.Source, w[1]) {
+			t.Errorf("%s comes from %s, want …%s", s.Key, s.Source, w[1])
+		}
+	}
+
+	for key := range want {
+		t.Errorf("%s missing from Effective", key)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+)
+
+// configCommand handles "magnesia [flags] config show [--effective]". Plain show
+// prints config.json as written; --effective prints every resolved value
+// together with the layer it came from. Neither shows the privacy salt.
+func configCommand(args []string) bool {
+	if len(args) == 0 || args[0] != "show" {
+		console.Error("Usage: magnesia config show [--effective]")
+		return false
+	}
+
+	fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+	effective := fs.Bool("effective", false, "Show resolved values and where each one comes from")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return false
+	}
+
+	if !*effective {
+		content, err := os.ReadFile(config.Path())
+		if err != nil {
+			console.Error("Error reading config: " + err.Error())
+			return false
+		}
+
+		content, err = withoutSalt(content)
+		if err != nil {
+			console.Error("Error reading config: " + err.Error())
+			return false
+		}
+
+		os.Stdout.Write(content)
+		return true
+	}
+
+	settings, err := config.Effective()
+	if err != nil {
+		console.Error("Error resolving config: " + err.Error())
+		return false
+	}
+
+	rows := make([][]string, 0, len(settings))
+	for _, s := range settings {
+		rows = append(rows, []string{s.Key, s.Value, s.Source})
+	}
+
+	console.Grid([]string{"Key", "Value", "Source"}, rows)
+
+	return true
+}
+
+// withoutSalt blanks privacy.salt in config.json. The file is printed as
+// written when it has no salt.
+func withoutSalt(content []byte) ([]byte, error) {
+	var file map[string]any
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+
+	privacy, _ := file["privacy"].(map[string]any)
+	if salt, _ := privacy["salt"].(string); salt == "" {
+		return content, nil
+	}
+	privacy["salt"] = ""
+
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(content, '\n'), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithoutSalt(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		same    bool
+	}{
+		{"no privacy", `{"uuid": "a"}`, true},
+		{"no salt", `{"uuid": "a", "privacy": {"profile": "standard"}}`, true},
+		{"salt", `{"uuid": "a", "privacy": {"profile": "standard", "salt": "s3cr3t"}}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withoutSalt([]byte(tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.same && string(got) != tt.content {
+				t.Errorf("withoutSalt rewrote %s to %s", tt.content, got)
+			}
+			if strings.Contains(string(got), "s3cr3t") || !strings.Contains(string(got), `"uuid": "a"`) {
+				t.Errorf("withoutSalt = %s", got)
+			}
+		})
+	}
+
+	if _, err := withoutSalt([]byte(`{"uuid": `)); err == nil {
+		t.Error("withoutSalt accepted invalid JSON")
+	}
+}
@@ -113,6 +113,48 @@ func Table(data interface{}) {
 	fmt.Printf("└%s┴%s┘\n", strings.Repeat("─", maxFieldLen+2), strings.Repeat("─", maxValLen+2))
 }
 
+// Grid prints rows under a header, one column per header cell.
+func Grid(header []string, rows [][]string) {
+	widths := make([]int, len(header))
+	for i, cell := range header {
+		widths[i] = len(cell)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if i < len(widths) && len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+
+	line := func(left, mid, right string) {
+		parts := make([]string, len(widths))
+		for i, w := range widths {
+			parts[i] = strings.Repeat("─", w+2)
+		}
+		fmt.Println(left + strings.Join(parts, mid) + right)
+	}
+
+	printRow := func(row []string) {
+		for i, w := range widths {
+			cell := ""
+			if i < len(row) {
+				cell = row[i]
+			}
+			fmt.Printf("│ %-*s ", w, cell)
+		}
+		fmt.Println("│")
+	}
+
+	line("┌", "┬", "┐")
+	printRow(header)
+	line("├", "┼", "┤")
+	for _, row := range rows {
+		printRow(row)
+	}
+	line("└", "┴", "┘")
+}
+
 // Log prints v to stdout as pretty JSON (print_r-like).
 // Falls back to a %#v dump if JSON marshaling fails.
 func Log(v any) {
@@ -3,6 +3,36 @@
 
 package console
 
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
 func EnableVirtualTerminal() {
 	// Nothing to do here, If you know you knows
 }
+
+func isTerminal() bool {
+	_, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), getTermios)
+	return err == nil
+}
+
+func disableEcho() (func(), error) {
+	fd := int(os.Stdin.Fd())
+
+	state, err := unix.IoctlGetTermios(fd, getTermios)
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := *state
+	hidden.Lflag &^= unix.ECHO
+	hidden.Lflag |= unix.ICANON | unix.ISIG
+
+	if err := unix.IoctlSetTermios(fd, setTermios, &hidden); err != nil {
+		return nil, err
+	}
+
+	return func() { _ = unix.IoctlSetTermios(fd, setTermios, state) }, nil
+}
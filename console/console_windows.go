@@ -7,6 +7,8 @@ import (
 	"os"
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/windows"
 )
 
 func EnableVirtualTerminal() {
@@ -22,3 +24,23 @@ func EnableVirtualTerminal() {
 	const ENABLE_VIRTUAL_TERMINAL_PROCESSING = 0x0004
 	setConsoleMode.Call(uintptr(handle), uintptr(mode|ENABLE_VIRTUAL_TERMINAL_PROCESSING))
 }
+
+func isTerminal() bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(os.Stdin.Fd()), &mode) == nil
+}
+
+func disableEcho() (func(), error) {
+	handle := windows.Handle(os.Stdin.Fd())
+
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return nil, err
+	}
+
+	if err := windows.SetConsoleMode(handle, mode&^windows.ENABLE_ECHO_INPUT); err != nil {
+		return nil, err
+	}
+
+	return func() { _ = windows.SetConsoleMode(handle, mode) }, nil
+}
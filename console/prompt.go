@@ -0,0 +1,43 @@
+package console
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// Interactive reports whether stdin is a terminal someone can answer
+// prompts on.
+func Interactive() bool {
+	return isTerminal()
+}
+
+// Prompt asks for a line of input.
+func Prompt(label string) (string, error) {
+	fmt.Print(cyan, " ", infoMark, " ", label, ": ", reset)
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+// Secret asks for a line of input without echoing it.
+func Secret(label string) (string, error) {
+	restore, err := disableEcho()
+	if err != nil {
+		return "", fmt.Errorf("failed to hide input: %v", err)
+	}
+
+	value, err := Prompt(label)
+
+	restore()
+	fmt.Println()
+
+	return value, err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/auh-xda/magnesia/console"
+)
+
+// credential is one install credential and the places it can come from.
+type credential struct {
+	flag   string
+	env    string
+	label  string
+	secret bool
+	value  *string
+}
+
+func (magnesia *Magnesia) credentials() []credential {
+	return []credential{
+		{flag: "auth_token", env: "MAGNESIA_AUTH_TOKEN", label: "Auth token", secret: true, value: &magnesia.AuthToken},
+		{flag: "api_key", env: "MAGNESIA_API_KEY", label: "API key", secret: true, value: &magnesia.ApiKey},
+		{flag: "client_id", env: "MAGNESIA_CLIENT_ID", label: "Client ID", value: &magnesia.ClientID},
+		{flag: "client_secret", env: "MAGNESIA_CLIENT_SECRET", label: "Client secret", secret: true, value: &magnesia.ClientSecret},
+	}
+}
+
+// CheckArgv refuses secrets given as flags, since argv is visible in ps,
+// shell history and the agent's own process list.
+func (magnesia *Magnesia) CheckArgv(insecureArgv bool) error {
+	if insecureArgv {
+		return nil
+	}
+
+	for _, c := range magnesia.credentials() {
+		if c.secret && *c.value != "" {
+			return fmt.Errorf("-%s on the command line is visible to other users; use %s, -credentials_file or the prompt instead, or pass -insecure-argv", c.flag, c.env)
+		}
+	}
+
+	return nil
+}
+
+// LoadCredentials fills in install credentials not given as flags, from the
+// environment, then the credentials file, and finally an interactive prompt
+// that does not echo secrets.
+func (magnesia *Magnesia) LoadCredentials(file string) error {
+	credentials := magnesia.credentials()
+
+	for _, c := range credentials {
+		if *c.value == "" {
+			*c.value = strings.TrimSpace(os.Getenv(c.env))
+		}
+	}
+
+	if file != "" {
+		values, err := readCredentialsFile(file)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range credentials {
+			if *c.value == "" {
+				*c.value = values[c.flag]
+			}
+		}
+	}
+
+	if !console.Interactive() {
+		return nil
+	}
+
+	for _, c := range credentials {
+		if *c.value != "" {
+			continue
+		}
+
+		var err error
+		if c.secret {
+			*c.value, err = console.Secret(c.label + " (leave empty if not used)")
+		} else {
+			*c.value, err = console.Prompt(c.label + " (leave empty if not used)")
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", strings.ToLower(c.label), err)
+		}
+	}
+
+	return nil
+}
+
+// readCredentialsFile reads a JSON object keyed like the flags, e.g.
+// {"client_id": "...", "client_secret": "..."}. On Unix the file must not
+// be accessible by group or others.
+func readCredentialsFile(path string) (map[string]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("credentials file %s has mode %04o, restrict it with chmod 600", path, info.Mode().Perm())
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+
+	values := map[string]string{}
+	if err := json.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %v", path, err)
+	}
+
+	return values, nil
+}
@@ -0,0 +1,220 @@
+// Package envelope defines the message the agent publishes and how it is
+// signed. It depends on nothing else in the agent so Momentum can import it
+// to verify what it receives.
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+// Envelope wraps every payload the agent publishes. Timestamp is in Unix
+// milliseconds and Sequence increases by one per envelope for the life of
+// the installation, so together they let the receiver spot replays.
+// Signature is a base64 Ed25519 signature of Canonical over all other
+// fields, made with the agent key named in Key. Redacted lists JSON
+// Pointers into the complete payload of fields that had secrets replaced,
+// and Profile names the privacy profile the payload was collected under.
+type Envelope struct {
+	MagnesiaUid       string   `json:"magnesia_uuid"`
+	MagnesiaClientId  string   `json:"magnesia_client_id"`
+	MagnesiaType      string   `json:"magnesia_type"`
+	MagnesiaPayload   any      `json:"magnesia_payload"`
+	MagnesiaDelta     bool     `json:"magnesia_delta"`
+	MagnesiaRedacted  []string `json:"magnesia_redacted,omitempty"`
+	MagnesiaProfile   string   `json:"magnesia_profile,omitempty"`
+	MagnesiaTimestamp int64    `json:"magnesia_timestamp"`
+	MagnesiaSequence  uint64   `json:"magnesia_sequence"`
+	MagnesiaKey       string   `json:"magnesia_key,omitempty"`
+	MagnesiaSignature string   `json:"magnesia_signature,omitempty"`
+}
+
+const signatureField = "magnesia_signature"
+
+// Canonical is the byte string that is signed: the JSON message without
+// its signature, objects with sorted keys, no insignificant whitespace and
+// numbers exactly as they were written.
+func Canonical(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var message map[string]any
+	if err := dec.Decode(&message); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %v", err)
+	}
+
+	delete(message, signatureField)
+
+	return json.Marshal(message)
+}
+
+// Sign marshals e and signs it with sign, which returns a raw Ed25519
+// signature made by the key whose public nkey is key.
+func Sign(e Envelope, key string, sign func([]byte) ([]byte, error)) ([]byte, error) {
+	e.MagnesiaKey = key
+	e.MagnesiaSignature = ""
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	canonical, err := Canonical(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := sign(canonical)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign envelope: %v", err)
+	}
+
+	e.MagnesiaSignature = base64.StdEncoding.EncodeToString(sig)
+
+	return json.Marshal(e)
+}
+
+// Verify checks that data is an envelope signed by publicKey, the nkey
+// Momentum registered for the agent, and returns it decoded. It does not
+// check for replays; see ReplayGuard.
+func Verify(data []byte, publicKey string) (Envelope, error) {
+	var e Envelope
+
+	if err := json.Unmarshal(data, &e); err != nil {
+		return e, fmt.Errorf("invalid envelope: %v", err)
+	}
+
+	if e.MagnesiaSignature == "" {
+		return e, fmt.Errorf("envelope is not signed")
+	}
+
+	if e.MagnesiaKey != publicKey {
+		return e, fmt.Errorf("envelope is signed by %s, expected %s", e.MagnesiaKey, publicKey)
+	}
+
+	kp, err := nkeys.FromPublicKey(publicKey)
+	if err != nil {
+		return e, fmt.Errorf("invalid public key: %v", err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(e.MagnesiaSignature)
+	if err != nil {
+		return e, fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	canonical, err := Canonical(data)
+	if err != nil {
+		return e, err
+	}
+
+	if err := kp.Verify(canonical, sig); err != nil {
+		return e, fmt.Errorf("bad envelope signature")
+	}
+
+	return e, nil
+}
+
+// DefaultWindow is how far behind the highest sequence ReplayGuard still
+// accepts an envelope when Window is not set.
+const DefaultWindow = 1024
+
+// ReplayGuard accepts each sequence of an agent at most once, and rejects
+// envelopes whose timestamp lies too far in the future. Collectors and
+// sinks run concurrently, so envelopes can arrive slightly out of order:
+// any sequence within Window of the highest one accepted is let through
+// once, anything older is rejected. Envelopes spooled while the agent was
+// offline arrive late but in order, so MaxAge should allow for the agent's
+// spool age; 0 disables it.
+type ReplayGuard struct {
+	MaxSkew time.Duration
+	MaxAge  time.Duration
+	Window  uint64
+
+	mu     sync.Mutex
+	agents map[string]*window
+}
+
+// window is what the guard remembers of one agent: the highest sequence
+// accepted, the sequences accepted within the window below it, and a floor
+// at or below which everything counts as seen.
+type window struct {
+	top   uint64
+	floor uint64
+	seen  map[uint64]bool
+}
+
+// Seen records that every sequence up to sequence was accepted from an
+// agent, e.g. from storage when the server restarts.
+func (g *ReplayGuard) Seen(uuid string, sequence uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	w := g.agent(uuid)
+	w.floor = max(w.floor, sequence)
+	w.top = max(w.top, sequence)
+}
+
+// Check accepts e at most once.
+func (g *ReplayGuard) Check(e Envelope) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sent := time.UnixMilli(e.MagnesiaTimestamp)
+
+	if g.MaxSkew > 0 && time.Until(sent) > g.MaxSkew {
+		return fmt.Errorf("envelope timestamp %s is in the future", sent.UTC().Format(time.RFC3339))
+	}
+
+	if g.MaxAge > 0 && time.Since(sent) > g.MaxAge {
+		return fmt.Errorf("envelope from %s is too old", sent.UTC().Format(time.RFC3339))
+	}
+
+	size := g.Window
+	if size == 0 {
+		size = DefaultWindow
+	}
+
+	w := g.agent(e.MagnesiaUid)
+	sequence := e.MagnesiaSequence
+
+	if sequence <= w.floor || w.top >= size && sequence <= w.top-size {
+		return fmt.Errorf("replayed envelope: sequence %d is behind the replay window, last seen %d", sequence, w.top)
+	}
+
+	if w.seen[sequence] {
+		return fmt.Errorf("replayed envelope: sequence %d was already seen", sequence)
+	}
+
+	w.seen[sequence] = true
+
+	if sequence > w.top {
+		w.top = sequence
+		for seen := range w.seen {
+			if w.top >= size && seen <= w.top-size {
+				delete(w.seen, seen)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (g *ReplayGuard) agent(uuid string) *window {
+	if g.agents == nil {
+		g.agents = map[string]*window{}
+	}
+
+	w, ok := g.agents[uuid]
+	if !ok {
+		w = &window{seen: map[uint64]bool{}}
+		g.agents[uuid] = w
+	}
+
+	return w
+}
@@ -0,0 +1,185 @@
+package envelope
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"sorted keys", `{"b": 1, "a": 2}`, `{"a":2,"b":1}`},
+		{"nested objects", `{"z": {"y": 1, "x": [ {"d": 1, "c": 2} ]}}`, `{"z":{"x":[{"c":2,"d":1}],"y":1}}`},
+		{"numbers as written", `{"a": 1.50, "b": 12345678901234567890, "c": 1e3}`, `{"a":1.50,"b":12345678901234567890,"c":1e3}`},
+		{"signature dropped", `{"magnesia_signature": "x", "a": 1}`, `{"a":1}`},
+		{"nested signature kept", `{"a": {"magnesia_signature": "x"}}`, `{"a":{"magnesia_signature":"x"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Canonical([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Canonical = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Canonical([]byte(`[1, 2]`)); err == nil {
+		t.Error("Canonical accepted a non-object")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := kp.PublicKey()
+
+	other, _ := nkeys.CreateUser()
+	otherPublic, _ := other.PublicKey()
+
+	e := Envelope{
+		MagnesiaUid:       "agent-1",
+		MagnesiaType:      "processlist",
+		MagnesiaPayload:   []any{map[string]any{"pid": 1, "cpu": 0.25}},
+		MagnesiaTimestamp: 1700000000000,
+		MagnesiaSequence:  7,
+	}
+
+	signed, err := Sign(e, public, kp.Sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := func(f func(m map[string]any)) []byte {
+		var m map[string]any
+		if err := json.Unmarshal(signed, &m); err != nil {
+			t.Fatal(err)
+		}
+		f(m)
+		data, _ := json.Marshal(m)
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		key     string
+		wantErr string
+	}{
+		{"valid", signed, public, ""},
+		{"reordered and reindented", tamper(func(map[string]any) {}), public, ""},
+		{"changed payload", tamper(func(m map[string]any) { m["magnesia_payload"] = []any{} }), public, "bad envelope signature"},
+		{"changed sequence", tamper(func(m map[string]any) { m["magnesia_sequence"] = 8 }), public, "bad envelope signature"},
+		{"added field", tamper(func(m map[string]any) { m["extra"] = true }), public, "bad envelope signature"},
+		{"unsigned", tamper(func(m map[string]any) { delete(m, "magnesia_signature") }), public, "not signed"},
+		{"other agent's key", signed, otherPublic, "signed by"},
+		{"key swapped in", tamper(func(m map[string]any) { m["magnesia_key"] = otherPublic }), otherPublic, "bad envelope signature"},
+		{"garbage signature", tamper(func(m map[string]any) { m["magnesia_signature"] = "!!" }), public, "signature encoding"},
+		{"not json", []byte("nope"), public, "invalid envelope"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Verify(tt.data, tt.key)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				if got.MagnesiaSequence != 7 || got.MagnesiaUid != "agent-1" {
+					t.Errorf("Verify returned %+v", got)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Verify error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Now()
+
+	type step struct {
+		uuid     string
+		sequence uint64
+		at       time.Time
+		ok       bool
+	}
+
+	tests := []struct {
+		name   string
+		window uint64
+		seen   map[string]uint64
+		steps  []step
+	}{
+		{"in order", 0, nil, []step{
+			{"a", 1, now, true}, {"a", 2, now, true}, {"a", 3, now, true},
+		}},
+		{"gaps", 0, nil, []step{
+			{"a", 1, now, true}, {"a", 5, now, true}, {"a", 9, now, true},
+		}},
+		{"out of order within the window", 0, nil, []step{
+			{"a", 2, now, true}, {"a", 1, now, true}, {"a", 4, now, true}, {"a", 3, now, true},
+		}},
+		{"duplicates", 0, nil, []step{
+			{"a", 1, now, true}, {"a", 2, now, true}, {"a", 1, now, false}, {"a", 2, now, false},
+		}},
+		{"behind the window", 4, nil, []step{
+			{"a", 1, now, true}, {"a", 10, now, true}, {"a", 6, now, false}, {"a", 7, now, true}, {"a", 7, now, false},
+		}},
+		{"agents are separate", 0, nil, []step{
+			{"a", 5, now, true}, {"b", 5, now, true}, {"b", 4, now, true}, {"a", 5, now, false},
+		}},
+		{"restored from storage", 0, map[string]uint64{"a": 10}, []step{
+			{"a", 9, now, false}, {"a", 10, now, false}, {"a", 12, now, true}, {"a", 11, now, true},
+		}},
+		{"timestamps", 0, nil, []step{
+			{"a", 1, now.Add(time.Hour), false}, {"a", 2, now.Add(-48 * time.Hour), false}, {"a", 3, now.Add(time.Second), true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &ReplayGuard{MaxSkew: time.Minute, MaxAge: 24 * time.Hour, Window: tt.window}
+			for uuid, sequence := range tt.seen {
+				g.Seen(uuid, sequence)
+			}
+
+			for i, s := range tt.steps {
+				err := g.Check(Envelope{MagnesiaUid: s.uuid, MagnesiaSequence: s.sequence, MagnesiaTimestamp: s.at.UnixMilli()})
+				if (err == nil) != s.ok {
+					t.Errorf("step %d (%s #%d): err = %v, want ok = %v", i, s.uuid, s.sequence, err, s.ok)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayGuardForgetsOldSequences(t *testing.T) {
+	g := &ReplayGuard{Window: 8}
+
+	for sequence := uint64(1); sequence <= 1000; sequence++ {
+		if err := g.Check(Envelope{MagnesiaUid: "a", MagnesiaSequence: sequence}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(g.agents["a"].seen); n > 8 {
+		t.Errorf("guard remembers %d sequences, want at most the window", n)
+	}
+}
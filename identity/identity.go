@@ -0,0 +1,233 @@
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/nats-io/nkeys"
+)
+
+// Headers carried by signed HTTP requests.
+const (
+	KeyHeader       = "X-Magnesia-Key"
+	TimestampHeader = "X-Magnesia-Timestamp"
+	SignatureHeader = "X-Magnesia-Signature"
+)
+
+// SeedPath holds the agent's private nkey seed. It is created at install
+// and never leaves the machine; only the public key is sent to Momentum.
+func SeedPath() string {
+	return filepath.Join(config.Dir(), "agent.nk")
+}
+
+// JWTPath holds the NATS user JWT Momentum issues for the agent's key, when
+// the server runs in operator mode.
+func JWTPath() string {
+	return filepath.Join(config.Dir(), "agent.jwt")
+}
+
+// PrivacyKeyPath holds the secret that keys the hashes of privacy profiles.
+// Like the seed it is random, created at install and never sent anywhere,
+// so a hashed value cannot be recovered by hashing guesses.
+func PrivacyKeyPath() string {
+	return filepath.Join(config.Dir(), "privacy.key")
+}
+
+// CreatePrivacyKey writes a new random privacy key unless one exists.
+func CreatePrivacyKey() error {
+	if _, err := os.Stat(PrivacyKeyPath()); err == nil {
+		return nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to create privacy key: %v", err)
+	}
+
+	return writeSecret(PrivacyKeyPath(), []byte(hex.EncodeToString(key)))
+}
+
+// PrivacyKey reads the privacy key, creating it first on agents installed
+// before it existed.
+func PrivacyKey() ([]byte, error) {
+	path := PrivacyKeyPath()
+
+	if err := CreatePrivacyKey(); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("privacy key %s has mode %04o, restrict it with chmod 600", path, info.Mode().Perm())
+	}
+
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) < 32 {
+		return nil, fmt.Errorf("privacy key %s is too short", path)
+	}
+
+	return key, nil
+}
+
+// Create makes a new NATS user keypair for the agent. It is kept in memory
+// until Save is called, so enrollment can register the public key before
+// the config directory exists.
+func Create() (nkeys.KeyPair, error) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create agent key: %v", err)
+	}
+	return kp, nil
+}
+
+// Save writes the seed of kp to SeedPath, readable by the owner only.
+func Save(kp nkeys.KeyPair) error {
+	seed, err := kp.Seed()
+	if err != nil {
+		return fmt.Errorf("failed to read agent key: %v", err)
+	}
+	defer wipe(seed)
+
+	return writeSecret(SeedPath(), seed)
+}
+
+// SaveJWT stores the NATS user JWT issued for the agent's key.
+func SaveJWT(jwt string) error {
+	return writeSecret(JWTPath(), []byte(jwt))
+}
+
+// Load reads the agent's keypair. Callers should Wipe it when done.
+func Load() (nkeys.KeyPair, error) {
+	path := SeedPath()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("agent key %s has mode %04o, restrict it with chmod 600", path, info.Mode().Perm())
+	}
+
+	seed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(seed)
+
+	kp, err := nkeys.ParseDecoratedNKey(seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent key %s: %v", path, err)
+	}
+
+	return kp, nil
+}
+
+// PublicKey is the agent's public nkey, "U…".
+func PublicKey() (string, error) {
+	kp, err := Load()
+	if err != nil {
+		return "", err
+	}
+	defer kp.Wipe()
+
+	return kp.PublicKey()
+}
+
+// Sign signs data with the agent's key.
+func Sign(data []byte) ([]byte, error) {
+	kp, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	defer kp.Wipe()
+
+	return kp.Sign(data)
+}
+
+// SignRequest adds the agent's public key, a timestamp and a base64
+// signature over RequestDigest to req.
+func SignRequest(req *http.Request, body []byte) error {
+	kp, err := Load()
+	if err != nil {
+		return err
+	}
+	defer kp.Wipe()
+
+	return SignRequestWith(kp, req, body)
+}
+
+// SignRequestWith is SignRequest with a key already loaded.
+func SignRequestWith(kp nkeys.KeyPair, req *http.Request, body []byte) error {
+	public, err := kp.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	sig, err := kp.Sign(RequestDigest(req.Method, req.URL.RequestURI(), timestamp, body))
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	req.Header.Set(KeyHeader, public)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(sig))
+
+	return nil
+}
+
+// RequestDigest is what SignRequest signs: the method, the path with its
+// query, the timestamp and the hex SHA-256 of the body, one per line.
+// Momentum rebuilds it to verify a request.
+func RequestDigest(method, uri, timestamp string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+
+	return []byte(strings.Join([]string{method, uri, timestamp, fmt.Sprintf("%x", sum)}, "\n"))
+}
+
+func writeSecret(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+
+	return nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 'x'
+	}
+}
@@ -3,15 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
 
 	"github.com/auh-xda/magnesia/client"
 	"github.com/auh-xda/magnesia/config"
 	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/identity"
 	"github.com/auh-xda/magnesia/installer"
-	"github.com/auh-xda/magnesia/interceptor"
 	"github.com/common-nighthawk/go-figure"
+	"github.com/nats-io/nkeys"
 )
 
 func (magnesia Magnesia) Install() {
@@ -20,56 +19,101 @@ func (magnesia Magnesia) Install() {
 	myFigure.Print()
 	console.ResetColor()
 
+	server := magnesia.Server
+
 	if magnesia.Installed() {
+		if server == "" {
+			existing, _ := config.ParseConfig()
+			server = existing.Momentum
+		}
+
 		console.Warn("Removing existing installation")
-		installer.Uninstall()
+		report(installer.Uninstall(installer.Options{}))
+	}
+
+	if server == "" {
+		console.Error("No Momentum server given, pass -server")
+		return
 	}
 
+	client.SetBaseURL(server)
+
 	console.Info("Installing...")
-	config, err := authenticateServer(magnesia)
+
+	key, err := identity.Create()
+	if err != nil {
+		console.Error(err.Error())
+		return
+	}
+	defer key.Wipe()
+
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		console.Error(err.Error())
+		return
+	}
+
+	auth, err := authenticateServer(magnesia, publicKey)
 
 	if err != nil {
 		console.Error("Authentication Failed")
 		return
 	}
 
-	if err := createConfigFile(config); err != nil {
+	cfg, err := enrolledConfig(auth, server)
+	if err != nil {
+		console.Error(err.Error())
+		return
+	}
+
+	if err := createConfigFile(cfg); err != nil {
 		console.Error(err.Error())
 		return
 	}
 
+	if err := saveIdentity(key, auth.NATSJWT); err != nil {
+		console.Error(err.Error())
+		return
+	}
+
+	// the service publishes the first inventory once it starts
 	err = installer.CreateService()
 
 	if err != nil {
 		console.Error(err.Error())
 		return
 	}
-
-	magnesia.Intercept()
-	magnesia.ProcessList()
-	interceptor.GetServices()
-	interceptor.InstalledSoftwareList()
 }
 
-func createConfigFile(cfg Config) error {
-	configDir := config.Dir()
+// enrolledConfig is the configuration to install: the defaults with what
+// Momentum sent on top.
+func enrolledConfig(auth AuthResponse, server string) (config.Config, error) {
+	cfg, err := config.Enrolled(auth.Config)
+	if err != nil {
+		return cfg, err
+	}
 
-	console.Info("Generating Magnesia configurations")
+	if cfg.Momentum == "" {
+		cfg.Momentum = server
+	}
 
-	if err := os.MkdirAll(configDir, 0755); err != nil {
-		return fmt.Errorf("failed to create config directory: %v", err)
+	// keep the TLS settings enrollment used unless Momentum sent its own
+	if bootstrap, err := config.Bootstrap(); err == nil && !cfg.TLS.Enabled() {
+		cfg.TLS = bootstrap.TLS
 	}
 
-	configFile := filepath.Join(configDir, "config.json")
+	return cfg, nil
+}
 
-	jsonData, err := json.MarshalIndent(cfg, "", "  ")
+func createConfigFile(cfg config.Config) error {
+	console.Info("Generating Magnesia configurations")
 
-	if err != nil {
-		return fmt.Errorf("failed to marshal config: %v", err)
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration from Momentum: %v", err)
 	}
 
-	if err := os.WriteFile(configFile, jsonData, 0644); err != nil {
-		return fmt.Errorf("failed to write config file: %v", err)
+	if err := config.Save(cfg); err != nil {
+		return err
 	}
 
 	console.Success("Config file updated")
@@ -77,15 +121,38 @@ func createConfigFile(cfg Config) error {
 	return nil
 }
 
-func authenticateServer(Agent Magnesia) (Config, error) {
+// saveIdentity stores the agent key registered during authentication, a new
+// privacy key, and the NATS user JWT when Momentum issued one for it.
+func saveIdentity(key nkeys.KeyPair, jwt string) error {
+	if err := identity.Save(key); err != nil {
+		return err
+	}
 
-	config := Config{}
+	if err := identity.CreatePrivacyKey(); err != nil {
+		return err
+	}
+
+	if jwt != "" {
+		if err := identity.SaveJWT(jwt); err != nil {
+			return err
+		}
+	}
+
+	console.Success("Agent key saved to " + identity.SeedPath())
+
+	return nil
+}
+
+func authenticateServer(Agent Magnesia, publicKey string) (AuthResponse, error) {
+
+	var Auth AuthResponse
 
 	authPayload := AuthRequest{
 		AuthToken:    Agent.AuthToken,
 		ClientID:     Agent.ClientID,
 		ClientSecret: Agent.ClientSecret,
 		ApiKey:       Agent.ApiKey,
+		PublicKey:    publicKey,
 	}
 
 	console.Info("Authenticating with server...")
@@ -93,25 +160,23 @@ func authenticateServer(Agent Magnesia) (Config, error) {
 	response, err := client.Post(authEndpoint, authPayload)
 
 	if err != nil {
-		console.Error("Some error occured while authenticating")
-		return config, err
+		console.Error("Some error occured while authenticating: " + err.Error())
+		return Auth, err
 	}
 
-	var Auth AuthResponse
-
 	err = json.Unmarshal(response.Body(), &Auth)
 
 	if err != nil {
 		console.Error("Unmarshal error")
-		return config, fmt.Errorf("error unmarshaling JSON: %s", err)
+		return Auth, fmt.Errorf("error unmarshaling JSON: %s", err)
 	}
 
 	if !Auth.Success {
 		console.Error(Auth.Message)
-		return config, fmt.Errorf("%s", Auth.Message)
+		return Auth, fmt.Errorf("%s", Auth.Message)
 	}
 
 	console.Success(Auth.Message)
 
-	return Auth.Config, nil
+	return Auth, nil
 }
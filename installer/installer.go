@@ -0,0 +1,103 @@
+package installer
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/auh-xda/magnesia/config"
+)
+
+// Options selects what Uninstall leaves behind.
+type Options struct {
+	KeepLogs   bool
+	KeepConfig bool
+}
+
+// Step is one line of the uninstall report.
+type Step struct {
+	Name string
+	Err  error
+}
+
+func step(name string, fn func() error) Step {
+	return Step{Name: name, Err: fn()}
+}
+
+func skipped(name string) Step {
+	return Step{Name: name + " (kept)"}
+}
+
+func command(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, msg)
+		}
+		return fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// removeFile treats an already missing file as removed.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func removeBinary() error {
+	for _, path := range []string{BinaryPath() + ".old", BinaryPath() + ".new"} {
+		_ = removeFile(path)
+	}
+	return removeFile(BinaryPath())
+}
+
+// dataSteps removes the spool and, unless it is kept, the rest of the
+// config directory. The script audit log counts as a log.
+func dataSteps(opts Options) []Step {
+	steps := []Step{step("Remove spool", func() error {
+		return os.RemoveAll(config.SpoolDir())
+	})}
+
+	if opts.KeepConfig {
+		return append(steps, skipped("Remove configuration"))
+	}
+
+	return append(steps, step("Remove configuration", func() error {
+		entries, err := os.ReadDir(config.Dir())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if opts.KeepLogs && e.Name() == "audit.log" {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(config.Dir(), e.Name())); err != nil {
+				return err
+			}
+		}
+
+		if opts.KeepLogs {
+			return nil
+		}
+		return removeFile(config.Dir())
+	}))
+}
+
+func logStep(opts Options, path string) Step {
+	if opts.KeepLogs {
+		return skipped("Remove log file")
+	}
+
+	return step("Remove log file", func() error {
+		return removeFile(path)
+	})
+}
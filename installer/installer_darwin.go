@@ -7,8 +7,8 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"syscall"
 
-	"github.com/auh-xda/magnesia/config"
 	"github.com/auh-xda/magnesia/console"
 )
 
@@ -38,6 +38,8 @@ func CreateService() error {
 	<key>ProgramArguments</key>
 	<array>
 		<string>%s</string>
+		<string>-action</string>
+		<string>run</string>
 	</array>
 	<key>RunAtLoad</key>
 	<true/>
@@ -63,12 +65,59 @@ func CreateService() error {
 	return nil
 }
 
-func Uninstall() {
+func Uninstall(opts Options) []Step {
 	plistFile := `/Library/LaunchDaemons/com.magnesia.agent.plist`
-	_ = exec.Command("launchctl", "unload", plistFile).Run()
-	_ = os.Remove(plistFile)
-	_ = os.Remove("/usr/local/bin/magnesia")
-	_ = os.Remove("/var/log/magnesia.log")
-	_ = os.RemoveAll(config.Dir())
-	console.Warn("Magnesia service removed from macOS")
+
+	steps := []Step{
+		step("Unload service", func() error { return command("launchctl", "unload", plistFile) }),
+		step("Remove launchd plist", func() error { return removeFile(plistFile) }),
+		step("Remove binary", removeBinary),
+	}
+
+	steps = append(steps, dataSteps(opts)...)
+
+	return append(steps, logStep(opts, "/var/log/magnesia.log"))
+}
+
+// ServiceName is the service CreateService registers the agent as.
+const ServiceName = "com.magnesia.agent"
+
+// BinaryPath is where CreateService installs the agent.
+func BinaryPath() string {
+	return "/usr/local/bin/magnesia"
+}
+
+func Restart() error {
+	if err := exec.Command("launchctl", "kickstart", "-k", "system/com.magnesia.agent").Run(); err != nil {
+		return fmt.Errorf("restart service failed: %v", err)
+	}
+	return nil
+}
+
+// Stop unloads the service, so launchd does not start it again.
+func Stop() error {
+	if err := exec.Command("launchctl", "unload", `/Library/LaunchDaemons/com.magnesia.agent.plist`).Run(); err != nil {
+		return fmt.Errorf("stop service failed: %v", err)
+	}
+	return nil
+}
+
+// Start loads the stopped service again, which starts it.
+func Start() error {
+	if err := exec.Command("launchctl", "load", `/Library/LaunchDaemons/com.magnesia.agent.plist`).Run(); err != nil {
+		return fmt.Errorf("start service failed: %v", err)
+	}
+	return nil
+}
+
+// Detach starts the agent binary with args in its own session, so launchd
+// does not kill it together with the service that spawned it.
+func Detach(name string, args ...string) error {
+	cmd := exec.Command(BinaryPath(), args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", name, err)
+	}
+	return cmd.Process.Release()
 }
@@ -5,7 +5,6 @@ import (
 	"os"
 	"os/exec"
 
-	"github.com/auh-xda/magnesia/config"
 	"github.com/auh-xda/magnesia/console"
 )
 
@@ -16,7 +15,8 @@ Description=Magnesia Agent
 After=network.target
 
 [Service]
-ExecStart=/usr/local/bin/magnesia
+ExecStart=/usr/local/bin/magnesia -action run
+ExecReload=/bin/kill -HUP $MAINPID
 Restart=always
 RestartSec=5
 User=root
@@ -61,7 +61,7 @@ WantedBy=multi-user.target
 	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
 		return fmt.Errorf("daemon-reload failed: %v", err)
 	}
-	if err := exec.Command("systemctl", "enable", "--now", "magnesia").Run(); err != nil {
+	if err := exec.Command("systemctl", "enable", "--now", ServiceName).Run(); err != nil {
 		return fmt.Errorf("enable service failed: %v", err)
 	}
 
@@ -69,18 +69,65 @@ WantedBy=multi-user.target
 	return nil
 }
 
-func Uninstall() {
+func Uninstall(opts Options) []Step {
 	serviceFile := `/etc/systemd/system/magnesia.service`
-	binaryFile := `/usr/local/bin/magnesia`
 	logFile := `/var/log/magnesia.log`
 
-	console.Warn("Disabling the service")
-	_ = exec.Command("systemctl", "stop", "magnesia").Run()
-	_ = exec.Command("systemctl", "disable", "magnesia").Run()
+	steps := []Step{
+		step("Stop service", func() error { return command("systemctl", "stop", ServiceName) }),
+		step("Disable service", func() error { return command("systemctl", "disable", ServiceName) }),
+		step("Remove unit file", func() error {
+			if err := removeFile(serviceFile); err != nil {
+				return err
+			}
+			return command("systemctl", "daemon-reload")
+		}),
+		step("Remove binary", removeBinary),
+	}
+
+	steps = append(steps, dataSteps(opts)...)
+
+	return append(steps, logStep(opts, logFile))
+}
+
+// ServiceName is the service CreateService registers the agent as.
+const ServiceName = "magnesia"
+
+// BinaryPath is where CreateService installs the agent.
+func BinaryPath() string {
+	return "/usr/local/bin/magnesia"
+}
+
+func Restart() error {
+	if err := exec.Command("systemctl", "restart", ServiceName).Run(); err != nil {
+		return fmt.Errorf("restart service failed: %v", err)
+	}
+	return nil
+}
 
-	console.Warn("Removing the daemons")
-	_ = os.Remove(serviceFile)
-	_ = os.Remove(binaryFile)
-	_ = os.Remove(logFile)
-	_ = os.RemoveAll(config.Dir())
+// Stop stops the service and waits until it has exited.
+func Stop() error {
+	if err := exec.Command("systemctl", "stop", ServiceName).Run(); err != nil {
+		return fmt.Errorf("stop service failed: %v", err)
+	}
+	return nil
+}
+
+// Start starts the stopped service.
+func Start() error {
+	if err := exec.Command("systemctl", "start", ServiceName).Run(); err != nil {
+		return fmt.Errorf("start service failed: %v", err)
+	}
+	return nil
+}
+
+// Detach starts the agent binary with args as a transient unit, outside the
+// service's cgroup, so it survives a restart of the service that spawned it.
+func Detach(name string, args ...string) error {
+	cmdArgs := append([]string{"--collect", "--unit=magnesia-" + name, BinaryPath()}, args...)
+
+	if err := exec.Command("systemd-run", cmdArgs...).Run(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", name, err)
+	}
+	return nil
 }
@@ -9,8 +9,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
 
-	"github.com/auh-xda/magnesia/config"
 	"github.com/auh-xda/magnesia/console"
 )
 
@@ -40,7 +40,7 @@ func CreateService() error {
 		return fmt.Errorf("failed to get executable path: %v", err)
 	}
 
-	targetBin := `C:\Program Files\Magnesia\magnesia.exe`
+	targetBin := BinaryPath()
 
 	// Ensure target directory exists
 	if err := os.MkdirAll(filepath.Dir(targetBin), os.ModePerm); err != nil {
@@ -53,16 +53,15 @@ func CreateService() error {
 	}
 
 	// Create Windows service
-	serviceName := "MagnesiaAgent"
-	createCmd := exec.Command("sc.exe", "create", serviceName,
-		"binPath=", targetBin,
+	createCmd := exec.Command("sc.exe", "create", ServiceName,
+		"binPath=", fmt.Sprintf(`"%s" -action run`, targetBin),
 		"start=", "auto")
 	if err := createCmd.Run(); err != nil {
 		return fmt.Errorf("failed to create service: %v", err)
 	}
 
 	// Start service
-	if err := exec.Command("sc.exe", "start", serviceName).Run(); err != nil {
+	if err := exec.Command("sc.exe", "start", ServiceName).Run(); err != nil {
 		return fmt.Errorf("failed to start service: %v", err)
 	}
 
@@ -70,11 +69,67 @@ func CreateService() error {
 	return nil
 }
 
-func Uninstall() {
-	serviceName := "MagnesiaAgent"
-	_ = exec.Command("sc.exe", "stop", serviceName).Run()
-	_ = exec.Command("sc.exe", "delete", serviceName).Run()
-	_ = os.Remove(`C:\Program Files\Magnesia\magnesia.exe`)
-	_ = os.RemoveAll(config.Dir())
-	console.Warn("Magnesia Windows service removed")
+func Uninstall(opts Options) []Step {
+	steps := []Step{
+		step("Stop service", func() error {
+			// net stop waits for the service to stop so the binary is released
+			return command("net", "stop", ServiceName)
+		}),
+		step("Delete service", func() error { return command("sc.exe", "delete", ServiceName) }),
+		step("Remove binary", removeBinary),
+	}
+
+	return append(steps, dataSteps(opts)...)
+}
+
+// ServiceName is the service CreateService registers the agent as.
+const ServiceName = "MagnesiaAgent"
+
+// BinaryPath is where CreateService installs the agent.
+func BinaryPath() string {
+	return `C:\Program Files\Magnesia\magnesia.exe`
+}
+
+// Restart uses net stop/start because, unlike sc.exe, they wait for the
+// service to reach the requested state.
+func Restart() error {
+	_ = Stop()
+
+	if err := exec.Command("net", "start", ServiceName).Run(); err != nil {
+		return fmt.Errorf("restart service failed: %v", err)
+	}
+	return nil
+}
+
+// Stop stops the service and waits until it has exited, which releases
+// its binary.
+func Stop() error {
+	if err := exec.Command("net", "stop", ServiceName).Run(); err != nil {
+		return fmt.Errorf("stop service failed: %v", err)
+	}
+	return nil
+}
+
+// Start starts the stopped service.
+func Start() error {
+	if err := exec.Command("net", "start", ServiceName).Run(); err != nil {
+		return fmt.Errorf("start service failed: %v", err)
+	}
+	return nil
+}
+
+// Detach starts the agent binary with args as a separate process that keeps
+// running when the service that spawned it is stopped.
+func Detach(name string, args ...string) error {
+	const detachedProcess = 0x00000008
+
+	cmd := exec.Command(BinaryPath(), args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", name, err)
+	}
+	return cmd.Process.Release()
 }
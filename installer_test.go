@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+)
+
+func TestInstallThenResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{"no config", `{"success": true}`},
+		{"few keys", `{"success": true, "config": {"uuid": "a1", "channel": "agents.a1", "client_id": "c1"}}`},
+		{"empty values", `{"success": true, "config": {"uuid": "a1", "transport": "", "interval": "", "spool": null, "privacy": {"profile": ""}}}`},
+		{"nested keys", `{"success": true, "config": {"uuid": "a1", "sinks": {"http": {"url": "https://ingest.example.com/data"}}, "spool": {"max_size_mb": 8}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+			var auth AuthResponse
+			if err := json.Unmarshal([]byte(tt.response), &auth); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := enrolledConfig(auth, "https://momentum.example.com")
+			if err != nil {
+				t.Fatalf("enrolledConfig: %v", err)
+			}
+
+			if err := createConfigFile(cfg); err != nil {
+				t.Fatalf("createConfigFile: %v", err)
+			}
+
+			resolved, _, err := config.Resolve()
+			if err != nil {
+				t.Fatalf("Resolve after install: %v", err)
+			}
+
+			if resolved.Momentum != "https://momentum.example.com" {
+				t.Errorf("server = %q", resolved.Momentum)
+			}
+			if resolved.Transport != "nats" {
+				t.Errorf("transport = %q, want the default", resolved.Transport)
+			}
+			if resolved.Privacy.Profile != "full" {
+				t.Errorf("privacy.profile = %q, want the default", resolved.Privacy.Profile)
+			}
+			if resolved.Interval.Duration != 5*time.Minute {
+				t.Errorf("interval = %s, want the default", resolved.Interval)
+			}
+			if resolved.Spool.MaxAge.Duration != 7*24*time.Hour {
+				t.Errorf("spool.max_age = %s, want the default", resolved.Spool.MaxAge)
+			}
+			if resolved.Sinks["http"].Retry.Attempts != 5 {
+				t.Errorf("sinks.http.retry.attempts = %d, want the default", resolved.Sinks["http"].Retry.Attempts)
+			}
+		})
+	}
+}
+
+func TestInstallKeepsServerValues(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	auth := AuthResponse{Config: json.RawMessage(`{"uuid": "a1", "server": "https://other.example.com", "sinks": {"http": {"url": "https://ingest.example.com/data"}}, "spool": {"max_size_mb": 8}}`)}
+
+	cfg, err := enrolledConfig(auth, "https://momentum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createConfigFile(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, _, err := config.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resolved.UUID != "a1" || resolved.Momentum != "https://other.example.com" {
+		t.Errorf("uuid, server = %q, %q", resolved.UUID, resolved.Momentum)
+	}
+	if resolved.Sinks["http"].URL != "https://ingest.example.com/data" {
+		t.Errorf("sinks.http.url = %q", resolved.Sinks["http"].URL)
+	}
+	if resolved.Spool.MaxSizeMB != 8 {
+		t.Errorf("spool.max_size_mb = %d", resolved.Spool.MaxSizeMB)
+	}
+}
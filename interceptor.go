@@ -9,9 +9,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/auh-xda/magnesia/config"
 	"github.com/auh-xda/magnesia/console"
 	"github.com/auh-xda/magnesia/interceptor"
-	"github.com/auh-xda/magnesia/nats"
+	"github.com/auh-xda/magnesia/privacy"
+	"github.com/auh-xda/magnesia/sink"
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/host"
 	"github.com/shirou/gopsutil/v3/mem"
@@ -28,9 +30,13 @@ func (magnesia Magnesia) Intercept() {
 	intercept.Version = version
 	intercept.SerialNumber = getProductSerial()
 
-	publicIP, err := exec.Command("curl", "-s", "https://ifconfig.me").Output()
-	if err == nil {
-		intercept.PublicIP = strings.TrimSpace(string(publicIP))
+	// looking up the public IP tells a third party about the host, skip it
+	// when the privacy profile would drop the answer anyway
+	if cfg, err := config.ParseConfig(); err != nil || !dropsPublicIP(cfg) {
+		publicIP, err := exec.Command("curl", "-s", "https://ifconfig.me").Output()
+		if err == nil {
+			intercept.PublicIP = strings.TrimSpace(string(publicIP))
+		}
 	}
 
 	info, err := host.Info()
@@ -56,7 +62,13 @@ func (magnesia Magnesia) Intercept() {
 	timeTaken := time.Since(start).Seconds()
 	console.Success(fmt.Sprintf("Information pulled up in %0.2f s", timeTaken))
 
-	nats.SendData(intercept, "intercept")
+	sink.SendData(intercept, "intercept")
+}
+
+func dropsPublicIP(cfg config.Config) bool {
+	profile, err := privacy.Load(cfg)
+
+	return err == nil && profile.Action("intercept", "public_ip") == privacy.Drop
 }
 
 func getProductSerial() string {
@@ -245,7 +257,7 @@ func (Magnesia) ProcessList() []ProcessInfo {
 
 	}
 
-	nats.SendData(processList, "processlist")
+	sink.SendData(processList, "processlist")
 
 	console.Success(fmt.Sprintf("%d processes running", len(processList)))
 
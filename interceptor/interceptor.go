@@ -4,7 +4,7 @@ import (
 	"fmt"
 
 	"github.com/auh-xda/magnesia/console"
-	"github.com/auh-xda/magnesia/nats"
+	"github.com/auh-xda/magnesia/sink"
 )
 
 func GetServices() {
@@ -15,7 +15,7 @@ func GetServices() {
 		return
 	}
 
-	nats.SendData(services, "services")
+	sink.SendData(services, "services")
 
 	console.Success(fmt.Sprintf("%d service fetched successfully", len(services)))
 }
@@ -25,7 +25,7 @@ func BatteryInfo(sendToNats bool) PowerInfo {
 	powerInfo, _ := GetPowerInfo()
 
 	if sendToNats {
-		nats.SendData(powerInfo, "power_info")
+		sink.SendData(powerInfo, "power_info")
 	}
 
 	return powerInfo
@@ -50,7 +50,7 @@ func InstalledSoftwareList() {
 		console.Error("failed to query installed software list")
 	}
 
-	nats.SendData(sw, "installations")
+	sink.SendData(sw, "installations")
 
 	console.Success(fmt.Sprintf("%d softwares are there ", len(sw)))
 }
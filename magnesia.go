@@ -1,12 +1,16 @@
 package main
 
 import (
+	"os"
+
 	"github.com/auh-xda/magnesia/config"
 	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/servicectl"
+	"github.com/auh-xda/magnesia/updater"
 )
 
 func (magnesia Magnesia) Installed() bool {
-	_, err := config.ParseConfig()
+	_, err := os.Stat(config.Path())
 
 	return nil == err
 }
@@ -14,5 +18,31 @@ func (magnesia Magnesia) Installed() bool {
 func (magnesia Magnesia) Info() {
 	config, _ := config.ParseConfig()
 
-	console.Table(config)
+	console.Table(config.Public())
+}
+
+func (magnesia Magnesia) ControlService(operation string, service string) {
+	config, _ := config.ParseConfig()
+
+	state, err := servicectl.Control(config.ServiceControl, operation, service)
+
+	if err != nil {
+		console.Error(err.Error())
+		return
+	}
+
+	console.Table(state)
+}
+
+func (magnesia Magnesia) Update(force bool) {
+	config, err := config.ParseConfig()
+
+	if err != nil {
+		console.Error("Error parsing config: " + err.Error())
+		return
+	}
+
+	if err := updater.Update(config, version, force); err != nil {
+		console.Error(err.Error())
+	}
 }
@@ -12,41 +12,109 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 
+	"github.com/auh-xda/magnesia/config"
 	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/installer"
 	"github.com/auh-xda/magnesia/interceptor"
+	"github.com/auh-xda/magnesia/nats"
 )
 
 const (
-	authEndpoint = "/api/auth/request"
-	version      = "0.1.0"
+	authEndpoint       = "/api/auth/request"
+	deregisterEndpoint = "/api/agent/deregister"
+	version            = "0.1.0"
 )
 
 func main() {
-	action := flag.String("action", "install", "Action to perform: install, update, or remove the Magnesia agent")
-	auth_token := flag.String("auth_token", "", "Authentication token provided by the server")
-	api_key := flag.String("api_key", "", "API key for your account")
+	action := flag.String("action", "install", "Action to perform: install, run, update, or remove the Magnesia agent")
+	auth_token := flag.String("auth_token", "", "Authentication token provided by the server (requires -insecure-argv, prefer MAGNESIA_AUTH_TOKEN)")
+	api_key := flag.String("api_key", "", "API key for your account (requires -insecure-argv, prefer MAGNESIA_API_KEY)")
 	client_id := flag.String("client_id", "", "Unique client identifier")
-	client_secret := flag.String("client_secret", "", "Client secret used for secure authentication")
+	client_secret := flag.String("client_secret", "", "Client secret used for secure authentication (requires -insecure-argv, prefer MAGNESIA_CLIENT_SECRET)")
+	credentialsFile := flag.String("credentials_file", "", "JSON file with install credentials, readable by its owner only")
+	insecureArgv := flag.Bool("insecure-argv", false, "Accept secrets given as command line flags")
+	server := flag.String("server", "", "Momentum server URL, required for install (e.g. https://momentum.example.com)")
+	service := flag.String("service", "", "Service to control with -action service")
+	operation := flag.String("operation", "", "Service operation: start, stop, restart, enable or disable")
+	keepLogs := flag.Bool("keep_logs", false, "Keep log files with -action remove")
+	keepConfig := flag.Bool("keep_config", false, "Keep the configuration directory with -action remove")
+	force := flag.Bool("force", false, "Install the latest release with -action update even if it is already running or older than this one")
+	interval := flag.String("interval", "", "Collector interval, overriding the configuration (e.g. 90s or 5m)")
+	tlsCA := flag.String("tls_ca", "", "PEM bundle of additional CAs trusted for Momentum and NATS")
+	tlsCert := flag.String("tls_cert", "", "Client certificate for mTLS")
+	tlsKey := flag.String("tls_key", "", "Private key of the client certificate")
+	tlsStrict := flag.Bool("tls_strict", false, "Refuse to enroll or publish over plaintext")
 
 	flag.Parse()
 
+	if *server != "" {
+		config.Override("server", *server, "server")
+	}
+	if *interval != "" {
+		config.Override("interval", *interval, "interval")
+	}
+	if *tlsCA != "" {
+		config.Override("tls.ca", *tlsCA, "tls_ca")
+	}
+	if *tlsCert != "" {
+		config.Override("tls.cert", *tlsCert, "tls_cert")
+	}
+	if *tlsKey != "" {
+		config.Override("tls.key", *tlsKey, "tls_key")
+	}
+	if *tlsStrict {
+		config.Override("tls.strict", "true", "tls_strict")
+	}
+
+	if flag.Arg(0) == "config" {
+		if !configCommand(flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	defer nats.Close()
+
 	magnesia := Magnesia{
 		AuthToken:    *auth_token,
 		ApiKey:       *api_key,
 		ClientID:     *client_id,
 		ClientSecret: *client_secret,
+		Server:       *server,
+	}
+
+	if err := magnesia.CheckArgv(*insecureArgv); err != nil {
+		console.Error(err.Error())
+		os.Exit(1)
 	}
 
-	if *action != "install" && !magnesia.Installed() {
+	// remove also cleans up after a broken or half finished install
+	if *action != "install" && *action != "remove" && !magnesia.Installed() {
 		console.Error("Magnesia not installed")
 		return
 	}
 
 	switch *action {
 	case "install":
+		if err := magnesia.LoadCredentials(*credentialsFile); err != nil {
+			console.Error(err.Error())
+			os.Exit(1)
+		}
 		magnesia.Install()
 
+	case "run":
+		magnesia.Run()
+
+	case "update":
+		magnesia.Update(*force)
+
+	case "remove":
+		if !magnesia.Remove(installer.Options{KeepLogs: *keepLogs, KeepConfig: *keepConfig}) {
+			os.Exit(1)
+		}
+
 	case "intercept":
 		magnesia.Intercept()
 
@@ -65,6 +133,9 @@ func main() {
 	case "software":
 		interceptor.InstalledSoftwareList()
 
+	case "service":
+		magnesia.ControlService(*operation, *service)
+
 	default:
 		console.Error(fmt.Sprintf("Magnesia is not aware of this action (i.e %s)", *action))
 	}
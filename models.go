@@ -1,29 +1,33 @@
 package main
 
 import (
+	"encoding/json"
+
 	"github.com/auh-xda/magnesia/interceptor"
 )
 
-type Config struct {
-	Version  string `json:"version"`
-	UUID     string `json:"uuid"`
-	Momentum string `json:"server"`
-	Interval string `json:"interval"`
-	Channel  string `json:"channel"`
-	ClientID string `json:"client_id"`
-}
-
+// AuthResponse carries the configuration Momentum assigned. Config is kept
+// raw so that only the keys Momentum sent replace the defaults.
 type AuthResponse struct {
-	Config  Config `json:"config"`
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Config  json.RawMessage `json:"config"`
+	NATSJWT string          `json:"nats_jwt,omitempty"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
 }
 
+// AuthRequest enrolls the agent. PublicKey is the agent's nkey; Momentum
+// registers it and may answer with a NATS user JWT for it.
 type AuthRequest struct {
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
 	AuthToken    string `json:"auth_token"`
 	ApiKey       string `json:"api_key"`
+	PublicKey    string `json:"public_key"`
+}
+
+type DeregisterRequest struct {
+	UUID     string `json:"uuid"`
+	ClientID string `json:"client_id"`
 }
 
 type Magnesia struct {
@@ -32,13 +36,7 @@ type Magnesia struct {
 	ClientSecret string `json:"client_secret"`
 	AuthToken    string `json:"auth_token"`
 	ApiKey       string `json:"api_key"`
-}
-
-type Websocket struct {
-	MagnesiaUid     string `json:"magnesia_uuid"`
-	MagnesiaPayload any    `json:"magnesia_payload"`
-	MagnesiaChannel string `json:"magnesia_channel"`
-	MagnesiaSiteId  string `json:"magnesia_site_id"`
+	Server       string `json:"server"`
 }
 
 type Interface struct {
@@ -0,0 +1,223 @@
+package nats
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/identity"
+	"github.com/auh-xda/magnesia/tlsconfig"
+	"github.com/auh-xda/magnesia/ws"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	reconnectWait    = 2 * time.Second
+	reconnectBufSize = 8 * 1024 * 1024
+	drainTimeout     = 10 * time.Second
+)
+
+var (
+	conn      *nats.Conn
+	connMu    sync.Mutex
+	closed    chan struct{}
+	connected []func(*nats.Conn)
+)
+
+// OnConnect registers fn to run on its own goroutine every time the
+// connection is established or re-established, e.g. to replay a spool.
+func OnConnect(fn func(*nats.Conn)) {
+	connMu.Lock()
+	defer connMu.Unlock()
+
+	connected = append(connected, fn)
+}
+
+// Connection returns the agent's long-lived NATS connection, dialing it on
+// first use. The servers come from the "nats" setting, which any config
+// layer can set (MAGNESIA_NATS points the agent at a local server). The
+// connection retries forever in the background and buffers publishes in
+// memory while it is reconnecting.
+func Connection() (*nats.Conn, error) {
+	connMu.Lock()
+	defer connMu.Unlock()
+
+	if conn != nil && !conn.IsClosed() {
+		return conn, nil
+	}
+
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	urls := cfg.NATSServers()
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no NATS server configured, set \"nats\" or \"server\" in config.json")
+	}
+
+	console.Info("Establishing connection with NATS")
+
+	auth, err := authOption(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	secure, err := tlsOption(cfg.TLS, urls)
+	if err != nil {
+		return nil, err
+	}
+
+	closed = make(chan struct{})
+	done := closed
+
+	nc, err := nats.Connect(strings.Join(urls, ","),
+		auth,
+		secure,
+		nats.Name("magnesia"),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(reconnectWait),
+		nats.ReconnectBufSize(reconnectBufSize),
+		nats.RetryOnFailedConnect(true),
+		nats.DrainTimeout(drainTimeout),
+		nats.ConnectHandler(func(nc *nats.Conn) {
+			console.Success("Connected to NATS at " + nc.ConnectedUrlRedacted())
+			runHooks(nc)
+		}),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err != nil {
+				console.Warn("Disconnected from NATS: " + err.Error())
+				return
+			}
+			console.Warn("Disconnected from NATS")
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			console.Success("Reconnected to NATS at " + nc.ConnectedUrlRedacted())
+			runHooks(nc)
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			console.Error("NATS error: " + err.Error())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			console.Warn("NATS connection closed")
+			close(done)
+		}),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn = nc
+
+	return conn, nil
+}
+
+// authOption picks how the agent identifies itself: an operator supplied
+// creds file from "nats_creds", the JWT Momentum issued at enrollment with
+// the agent's seed, or the bare agent nkey. An agent enrolled before keys
+// existed connects anonymously.
+func authOption(cfg config.Config) (nats.Option, error) {
+	if cfg.NATSCreds != "" {
+		return nats.UserCredentials(cfg.NATSCreds), nil
+	}
+
+	if _, err := os.Stat(identity.SeedPath()); os.IsNotExist(err) {
+		console.Warn("No agent key found, connecting to NATS anonymously; reinstall to enroll one")
+		return func(*nats.Options) error { return nil }, nil
+	}
+
+	kp, err := identity.Load()
+	if err != nil {
+		return nil, err
+	}
+	kp.Wipe()
+
+	if _, err := os.Stat(identity.JWTPath()); err == nil {
+		return nats.UserCredentials(identity.JWTPath(), identity.SeedPath()), nil
+	}
+
+	option, err := nats.NkeyOptionFromSeed(identity.SeedPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load agent key: %v", err)
+	}
+
+	return option, nil
+}
+
+// tlsOption requires TLS when any TLS setting is present or a URL asks for
+// it. nats:// URLs are upgraded in-band, so strict mode only has to refuse
+// plain WebSocket URLs.
+func tlsOption(settings config.TLS, urls []string) (nats.Option, error) {
+	secure := settings.Enabled()
+
+	for _, u := range urls {
+		plaintext := tlsconfig.Plaintext(u)
+		if settings.Strict && plaintext && strings.HasPrefix(u, "ws://") {
+			return nil, fmt.Errorf("refusing plaintext NATS URL %s, tls.strict is set", u)
+		}
+		if !plaintext {
+			secure = true
+		}
+	}
+
+	if !secure {
+		return func(*nats.Options) error { return nil }, nil
+	}
+
+	conf, err := tlsconfig.New(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return nats.Secure(conf), nil
+}
+
+// Close drains the connection so buffered and in-flight messages are
+// delivered before the agent exits, and closes the WebSocket if one is open.
+func Close() {
+	ws.Close()
+
+	connMu.Lock()
+	nc, done := conn, closed
+	conn = nil
+	connMu.Unlock()
+
+	if nc == nil || nc.IsClosed() {
+		return
+	}
+
+	if !nc.IsConnected() {
+		if pending, err := nc.Buffered(); err == nil && pending > 0 {
+			console.Warn(fmt.Sprintf("Dropping %d buffered bytes, NATS is not connected", pending))
+		}
+		nc.Close()
+		return
+	}
+
+	if err := nc.Drain(); err != nil {
+		console.Error("Error draining NATS connection: " + err.Error())
+		nc.Close()
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(drainTimeout + time.Second):
+		nc.Close()
+	}
+}
+
+func runHooks(nc *nats.Conn) {
+	connMu.Lock()
+	hooks := append([]func(*nats.Conn){}, connected...)
+	connMu.Unlock()
+
+	for _, fn := range hooks {
+		go fn(nc)
+	}
+}
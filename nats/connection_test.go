@@ -0,0 +1,205 @@
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/nats-io/nats.go"
+)
+
+// fakeServer speaks just enough of the NATS client protocol for the agent's
+// connection: INFO, PING/PONG and PUB/HPUB. The real nats-server is not a
+// dependency of this module, so it cannot run in process here.
+type fakeServer struct {
+	ln       net.Listener
+	received chan string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	refuse bool
+}
+
+func startFake(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeServer{ln: ln, received: make(chan string, 16)}
+	go f.accept()
+
+	return f
+}
+
+func (f *fakeServer) url() string {
+	return "nats://" + f.ln.Addr().String()
+}
+
+func (f *fakeServer) accept() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		if f.refuse {
+			f.mu.Unlock()
+			c.Close()
+			continue
+		}
+		f.conn = c
+		f.mu.Unlock()
+
+		go f.serve(c)
+	}
+}
+
+func (f *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+
+	fmt.Fprint(c, `INFO {"server_id":"fake","version":"2.10.0","proto":1,"headers":true,"max_payload":1048576}`+"\r\n")
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			fmt.Fprint(c, "PONG\r\n")
+
+		case "PUB", "HPUB":
+			headers := 0
+			if fields[0] == "HPUB" {
+				headers, _ = strconv.Atoi(fields[len(fields)-2])
+			}
+			total, _ := strconv.Atoi(fields[len(fields)-1])
+
+			payload := make([]byte, total+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			f.received <- fields[1] + " " + string(payload[headers:total])
+		}
+	}
+}
+
+// drop cuts the client off and refuses it until resume.
+func (f *fakeServer) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.refuse = true
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+func (f *fakeServer) resume() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.refuse = false
+}
+
+func (f *fakeServer) expect(t *testing.T, want string) {
+	t.Helper()
+
+	select {
+	case got := <-f.received:
+		if got != want {
+			t.Errorf("server received %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server never received %q", want)
+	}
+}
+
+func wait(t *testing.T, what string, ch <-chan struct{}, timeout time.Duration) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(timeout):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestConnection(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	server := startFake(t)
+
+	cfg := config.Defaults()
+	cfg.UUID = "test"
+	cfg.NATS = []string{server.url()}
+	if err := config.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	connects := make(chan struct{}, 4)
+	OnConnect(func(*nats.Conn) { connects <- struct{}{} })
+
+	nc, err := Connection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(t, "the connect hook", connects, 5*time.Second)
+
+	if again, _ := Connection(); again != nc {
+		t.Error("Connection dialed a second connection")
+	}
+
+	if err := nc.Publish("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	server.expect(t, "a 1")
+
+	// publishes are buffered while the server is gone
+	server.drop()
+	for deadline := time.Now().Add(5 * time.Second); nc.IsConnected(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still up after the server dropped it")
+		}
+	}
+
+	if err := nc.Publish("b", []byte("2")); err != nil {
+		t.Fatalf("publish while reconnecting: %v", err)
+	}
+	if buffered, err := nc.Buffered(); err != nil || buffered == 0 {
+		t.Errorf("Buffered = %d, %v, want the pending publish", buffered, err)
+	}
+
+	// and flushed once it reconnects, which runs the hooks again
+	server.resume()
+	wait(t, "the reconnect hook", connects, 10*time.Second)
+	server.expect(t, "b 2")
+
+	// Close drains what is still in flight
+	if err := nc.Publish("c", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	server.expect(t, "c 3")
+
+	if !nc.IsClosed() {
+		t.Error("connection still open after Close")
+	}
+}
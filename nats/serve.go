@@ -0,0 +1,73 @@
+package nats
+
+import (
+	"encoding/json"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/ws"
+	"github.com/nats-io/nats.go"
+)
+
+// CommandSubject is the per-agent subject the server sends requests to.
+func CommandSubject(cfg config.Config) string {
+	return cfg.Channel + "." + cfg.UUID + ".commands"
+}
+
+// JobSubject is where the output of a long-running job is streamed.
+func JobSubject(cfg config.Config, id string) string {
+	return cfg.Channel + "." + cfg.UUID + ".jobs." + id
+}
+
+// Publish sends v as JSON on subject over the shared connection, without
+// delta handling or spooling. It suits live data such as job output.
+func Publish(subject string, v any) error {
+	nc, err := transport()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return nc.Publish(subject, data)
+}
+
+// Serve answers every request on subject with the reply built by handler.
+// Each request is handled on its own goroutine so a long job does not hold
+// up the next command. The subscription lives on the shared connection and
+// is restored by the client after a reconnect. With the WebSocket
+// transport the requests are pushed by Momentum over the socket instead.
+func Serve(subject string, handler func(data []byte) []byte) error {
+	if useWebSocket() {
+		return ws.Serve(subject, handler)
+	}
+
+	nc, err := Connection()
+	if err != nil {
+		return err
+	}
+
+	_, err = nc.Subscribe(subject, func(msg *nats.Msg) {
+		go func() {
+			reply := handler(msg.Data)
+
+			if msg.Reply == "" {
+				return
+			}
+
+			if err := msg.Respond(reply); err != nil {
+				console.Error("Error replying to " + subject + ": " + err.Error())
+			}
+		}()
+	})
+	if err != nil {
+		return err
+	}
+
+	console.Success("Listening for commands on " + subject)
+
+	return nil
+}
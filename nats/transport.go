@@ -0,0 +1,36 @@
+package nats
+
+import (
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/ws"
+)
+
+// publisher is what Publish needs from a connection; *nats.Conn and
+// *ws.Conn both provide it.
+type publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// useWebSocket reports whether "transport" selects the WebSocket to Momentum.
+func useWebSocket() bool {
+	cfg, err := config.ParseConfig()
+
+	return err == nil && cfg.Transport == "websocket"
+}
+
+// transport returns the connection selected in the configuration.
+func transport() (publisher, error) {
+	if useWebSocket() {
+		c, err := ws.Connection()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	nc, err := Connection()
+	if err != nil {
+		return nil, err
+	}
+	return nc, nil
+}
@@ -0,0 +1,301 @@
+package privacy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/identity"
+)
+
+// What a profile does with a field.
+const (
+	Collect = "collect"
+	Hash    = "hash"
+	Drop    = "drop"
+)
+
+// Rules maps a payload type to field paths and their action. Paths are
+// dotted JSON keys where "*" matches any list index, e.g. "*.cmdline" in
+// the process list or "interfaces.*.mac" in intercept.
+type Rules map[string]map[string]string
+
+var builtins = map[string]Rules{
+	"full": {},
+
+	"standard": {
+		"intercept": {
+			"public_ip":        Hash,
+			"interfaces.*.mac": Hash,
+		},
+		"processlist": {
+			"*.username": Hash,
+		},
+	},
+
+	"minimal": {
+		"intercept": {
+			"hostname":                  Hash,
+			"product_serial":            Hash,
+			"host_id":                   Hash,
+			"public_ip":                 Drop,
+			"interfaces.*.mac":          Hash,
+			"interfaces.*.ip_addresses": Drop,
+			"power.serial":              Drop,
+		},
+		"processlist": {
+			"*.username": Hash,
+			"*.cmdline":  Drop,
+			"*.exe":      Drop,
+		},
+		"services": {
+			"*.description": Drop,
+		},
+		"installations": {
+			"*.install_location": Drop,
+			"*.install_source":   Drop,
+			"*.uninstall_string": Drop,
+			"*.quiet_uninstall":  Drop,
+			"*.icon_path":        Drop,
+		},
+		"power_info": {
+			"serial": Drop,
+		},
+	},
+}
+
+// Profile is the active set of rules.
+type Profile struct {
+	Name  string
+	rules map[string][]rule
+	salt  []byte
+}
+
+// rule is one selector of a profile, split into its path parts.
+type rule struct {
+	selector []string
+	action   string
+}
+
+// Load returns the profile selected in cfg. Custom profiles from
+// "privacy.profiles" take precedence over the built-in ones. Hashes are
+// keyed with "privacy.salt" when set and with the agent's privacy key
+// otherwise.
+func Load(cfg config.Config) (Profile, error) {
+	name := cfg.Privacy.Profile
+	if name == "" {
+		name = "full"
+	}
+
+	rules, ok := Rules(cfg.Privacy.Profiles[name]), cfg.Privacy.Profiles[name] != nil
+	if !ok {
+		rules, ok = builtins[name]
+	}
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown privacy profile %q", name)
+	}
+
+	p := Profile{Name: name, rules: compile(rules)}
+
+	if !p.hashes() {
+		return p, nil
+	}
+
+	if cfg.Privacy.Salt != "" {
+		p.salt = []byte(cfg.Privacy.Salt)
+		return p, nil
+	}
+
+	key, err := identity.PrivacyKey()
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to load privacy key: %v", err)
+	}
+	p.salt = key
+
+	return p, nil
+}
+
+// compile orders the selectors of each payload type most specific first,
+// so the rule applied to a field matched by several does not depend on map
+// order. A selector is more specific when it has fewer "*", and on a tie
+// when its first "*" comes later.
+func compile(rules Rules) map[string][]rule {
+	compiled := make(map[string][]rule, len(rules))
+
+	for payloadType, fields := range rules {
+		list := make([]rule, 0, len(fields))
+		for selector, action := range fields {
+			list = append(list, rule{selector: strings.Split(selector, "."), action: action})
+		}
+
+		sort.Slice(list, func(i, j int) bool {
+			return moreSpecific(list[i].selector, list[j].selector)
+		})
+
+		compiled[payloadType] = list
+	}
+
+	return compiled
+}
+
+func moreSpecific(a, b []string) bool {
+	if wa, wb := wildcards(a), wildcards(b); wa != wb {
+		return wa < wb
+	}
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if (a[i] == "*") != (b[i] == "*") {
+			return b[i] == "*"
+		}
+	}
+
+	return strings.Join(a, ".") < strings.Join(b, ".")
+}
+
+func wildcards(selector []string) int {
+	n := 0
+	for _, part := range selector {
+		if part == "*" {
+			n++
+		}
+	}
+	return n
+}
+
+func (p Profile) hashes() bool {
+	for _, rules := range p.rules {
+		for _, r := range rules {
+			if r.action == Hash {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Action is what the profile does with path in payloadType.
+func (p Profile) Action(payloadType, path string) string {
+	for _, r := range p.rules[payloadType] {
+		if match(r.selector, strings.Split(path, ".")) {
+			return r.action
+		}
+	}
+	return Collect
+}
+
+// Apply hashes and drops fields of payload according to the profile and
+// returns it as generic JSON.
+func (p Profile) Apply(payloadType string, payload any) (any, error) {
+	rules := p.rules[payloadType]
+	if len(rules) == 0 {
+		return payload, nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var tree any
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+
+	tree, _ = p.walk(tree, nil, rules)
+
+	return tree, nil
+}
+
+// walk returns the new value of v and false when it is to be dropped.
+func (p Profile) walk(v any, path []string, rules []rule) (any, bool) {
+	if len(path) > 0 {
+		for _, r := range rules {
+			if !match(r.selector, path) {
+				continue
+			}
+			switch r.action {
+			case Drop:
+				return nil, false
+			case Hash:
+				return p.hash(v), true
+			}
+			break
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for k, sub := range v {
+			if value, keep := p.walk(sub, append(path, k), rules); keep {
+				v[k] = value
+			} else {
+				delete(v, k)
+			}
+		}
+	case []any:
+		kept := v[:0]
+		for i, sub := range v {
+			if value, keep := p.walk(sub, append(path, strconv.Itoa(i)), rules); keep {
+				kept = append(kept, value)
+			}
+		}
+		return kept, true
+	}
+
+	return v, true
+}
+
+// hash replaces every scalar in v with a keyed hash, so equal values stay
+// comparable without being readable. Empty strings are left alone.
+func (p Profile) hash(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, sub := range v {
+			v[k] = p.hash(sub)
+		}
+		return v
+	case []any:
+		for i, sub := range v {
+			v[i] = p.hash(sub)
+		}
+		return v
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return v
+		}
+		return p.sum(v)
+	default:
+		return p.sum(fmt.Sprint(v))
+	}
+}
+
+func (p Profile) sum(value string) string {
+	mac := hmac.New(sha256.New, p.salt)
+	mac.Write([]byte(value))
+
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func match(selector, path []string) bool {
+	if len(selector) != len(path) {
+		return false
+	}
+	for i, part := range selector {
+		if part != "*" && part != path[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/identity"
+)
+
+func profileConfig(rules map[string]map[string]string) config.Config {
+	cfg := config.Defaults()
+	cfg.UUID = "agent-1"
+	cfg.Privacy = config.Privacy{
+		Profile:  "custom",
+		Salt:     "test-salt",
+		Profiles: map[string]map[string]map[string]string{"custom": rules},
+	}
+	return cfg
+}
+
+func TestActionMostSpecificFirst(t *testing.T) {
+	rules := map[string]map[string]string{
+		"intercept": {
+			"interfaces.*.mac":    Hash,
+			"interfaces.0.mac":    Collect,
+			"interfaces.*.*":      Drop,
+			"*.0.name":            Hash,
+			"interfaces.0.*":      Drop,
+			"hostname":            Hash,
+			"interfaces.*.status": Collect,
+		},
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"interfaces.0.mac", Collect},
+		{"interfaces.1.mac", Hash},
+		{"interfaces.1.status", Collect},
+		{"interfaces.1.speed", Drop},
+		{"interfaces.0.speed", Drop},
+		{"interfaces.0.name", Drop},
+		{"disks.0.name", Hash},
+		{"hostname", Hash},
+		{"uptime", Collect},
+	}
+
+	// map order changes between runs, the answer must not
+	for run := 0; run < 20; run++ {
+		p, err := Load(profileConfig(rules))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range tests {
+			if got := p.Action("intercept", tt.path); got != tt.want {
+				t.Fatalf("run %d: Action(%s) = %s, want %s", run, tt.path, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	sum := func(value string) string {
+		mac := hmac.New(sha256.New, []byte("test-salt"))
+		mac.Write([]byte(value))
+		return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	intercept := map[string]any{
+		"hostname":  "laptop",
+		"public_ip": "203.0.113.7",
+		"interfaces": []any{
+			map[string]any{"name": "eth0", "mac": "aa:bb", "ip_addresses": []any{"10.0.0.2"}},
+			map[string]any{"name": "lo", "mac": "", "ip_addresses": []any{"127.0.0.1"}},
+		},
+		"power": map[string]any{"serial": "X1", "level": 80},
+	}
+
+	tests := []struct {
+		name        string
+		profile     string
+		payloadType string
+		payload     any
+		want        any
+	}{
+		{"full leaves everything", "full", "intercept", intercept, intercept},
+		{
+			"standard", "standard", "intercept", intercept,
+			map[string]any{
+				"hostname":  "laptop",
+				"public_ip": sum("203.0.113.7"),
+				"interfaces": []any{
+					map[string]any{"name": "eth0", "mac": sum("aa:bb"), "ip_addresses": []any{"10.0.0.2"}},
+					map[string]any{"name": "lo", "mac": "", "ip_addresses": []any{"127.0.0.1"}},
+				},
+				"power": map[string]any{"serial": "X1", "level": 80},
+			},
+		},
+		{
+			"minimal", "minimal", "intercept", intercept,
+			map[string]any{
+				"hostname": sum("laptop"),
+				"interfaces": []any{
+					map[string]any{"name": "eth0", "mac": sum("aa:bb")},
+					map[string]any{"name": "lo", "mac": ""},
+				},
+				"power": map[string]any{"level": 80},
+			},
+		},
+		{
+			"minimal process list", "minimal", "processlist",
+			[]any{map[string]any{"pid": 1, "username": "root", "cmdline": "init", "exe": "/sbin/init"}},
+			[]any{map[string]any{"pid": 1, "username": sum("root")}},
+		},
+		{"type without rules", "minimal", "power", map[string]any{"level": 80}, map[string]any{"level": 80}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Defaults()
+			cfg.Privacy = config.Privacy{Profile: tt.profile, Salt: "test-salt"}
+
+			p, err := Load(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := p.Apply(tt.payloadType, tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(normalize(t, got), normalize(t, tt.want)) {
+				t.Errorf("Apply = %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashKeyIsNotPublic(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	cfg := config.Defaults()
+	cfg.UUID = "agent-1"
+	cfg.Privacy.Profile = "full"
+
+	if _, err := Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(identity.PrivacyKeyPath()); !os.IsNotExist(err) {
+		t.Fatalf("full profile created a privacy key: %v", err)
+	}
+
+	cfg.Privacy.Profile = "standard"
+
+	p, err := Load(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(identity.PrivacyKeyPath())
+	if err != nil {
+		t.Fatalf("no privacy key after loading a hashing profile: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("privacy key mode = %04o, want 0600", info.Mode().Perm())
+	}
+
+	withUUID := Profile{salt: []byte(cfg.UUID)}
+	if p.sum("aa:bb") == withUUID.sum("aa:bb") {
+		t.Error("hash is keyed with the agent UUID")
+	}
+
+	again, err := Load(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.sum("aa:bb") != again.sum("aa:bb") {
+		t.Error("hash changed between loads")
+	}
+
+	if err := os.Chmod(identity.PrivacyKeyPath(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(cfg); runtime.GOOS != "windows" && err == nil {
+		t.Error("loaded a privacy key readable by others")
+	}
+}
+
+func normalize(t *testing.T, v any) any {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
@@ -0,0 +1,140 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Marker replaces every redacted value, so the receiver can tell a secret
+// was removed rather than the field being empty.
+const Marker = "[REDACTED]"
+
+// Rule is one pattern. When it has a capture group only the group is
+// replaced, which keeps "--password=" readable while hiding the value.
+type Rule struct {
+	Name string
+	re   *regexp.Regexp
+}
+
+var builtins = []Rule{
+	{"password flag", regexp.MustCompile(`(?i)(?:^|\s)--?[a-z0-9_-]*(?:password|passwd|pwd|secret|token|api[_-]?key|access[_-]?key|credentials?)[a-z0-9_-]*(?:=|\s+)("[^"]*"|'[^']*'|\S+)`)},
+	{"secret variable", regexp.MustCompile(`(?i)\b[a-z0-9_]*(?:password|passwd|secret|token|api_?key)[a-z0-9_]*=("[^"]*"|'[^']*'|\S+)`)},
+	{"url credentials", regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s:/@]+:([^\s@/]+)@`)},
+	{"bearer token", regexp.MustCompile(`(?i)\bbearer\s+([a-z0-9._~+/-]+=*)`)},
+	{"jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)},
+	{"aws access key", regexp.MustCompile(`\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`)},
+	{"aws secret key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`)},
+}
+
+// Redactor applies the built-in rules and any operator patterns.
+type Redactor struct {
+	rules []Rule
+}
+
+// New compiles patterns, the "redact.patterns" list from the
+// configuration, after the built-in rules.
+func New(patterns []string) (*Redactor, error) {
+	r := &Redactor{rules: append([]Rule(nil), builtins...)}
+
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %d: %v", i, err)
+		}
+		r.rules = append(r.rules, Rule{Name: "pattern " + strconv.Itoa(i), re: re})
+	}
+
+	return r, nil
+}
+
+// String redacts s and reports whether anything was replaced.
+func (r *Redactor) String(s string) (string, bool) {
+	changed := false
+
+	for _, rule := range r.rules {
+		matches := rule.re.FindAllStringSubmatchIndex(s, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		var b strings.Builder
+		last := 0
+
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			if s[start:end] == Marker {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(Marker)
+			last = end
+			changed = true
+		}
+
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+
+	return s, changed
+}
+
+// Payload redacts every string in payload. It returns the payload as
+// generic JSON and the JSON Pointers of the fields that were changed.
+func (r *Redactor) Payload(payload any) (any, []string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var tree any
+	if err := dec.Decode(&tree); err != nil {
+		return nil, nil, err
+	}
+
+	var paths []string
+	tree = r.walk(tree, "", &paths)
+	sort.Strings(paths)
+
+	return tree, paths, nil
+}
+
+func (r *Redactor) walk(v any, path string, paths *[]string) any {
+	switch v := v.(type) {
+	case string:
+		s, changed := r.String(v)
+		if changed {
+			*paths = append(*paths, path)
+		}
+		return s
+
+	case map[string]any:
+		for k, sub := range v {
+			v[k] = r.walk(sub, path+"/"+escape(k), paths)
+		}
+		return v
+
+	case []any:
+		for i, sub := range v {
+			v[i] = r.walk(sub, path+"/"+strconv.Itoa(i), paths)
+		}
+		return v
+
+	default:
+		return v
+	}
+}
+
+func escape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/auh-xda/magnesia/client"
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/installer"
+)
+
+// Remove uninstalls the agent and then tells Momentum it is decommissioned,
+// printing one line per step. It works without a valid config.json, the
+// server is then taken from -server. It reports false if any step failed;
+// the remaining steps are still attempted.
+func (magnesia Magnesia) Remove(opts installer.Options) bool {
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		console.Warn("Configuration unreadable, removing Magnesia anyway: " + err.Error())
+	}
+
+	if magnesia.Server != "" {
+		client.SetBaseURL(magnesia.Server)
+	}
+
+	console.Warn("Removing Magnesia")
+
+	// the server is told last, so an agent that failed to uninstall is not
+	// left running unknown to it. What the request needs lives in the
+	// config directory, so load it before Uninstall removes it.
+	notify := deregistration(cfg)
+
+	steps := installer.Uninstall(opts)
+	steps = append(steps, installer.Step{Name: "Notify server", Err: notify()})
+
+	return report(steps)
+}
+
+func deregistration(cfg config.Config) func() error {
+	if cfg.UUID == "" {
+		return func() error {
+			return fmt.Errorf("agent UUID unknown, remove the agent in Momentum")
+		}
+	}
+
+	c, release, err := client.Prepare()
+	if err != nil {
+		return func() error { return err }
+	}
+
+	return func() error {
+		defer release()
+
+		response, err := c.R().SetBody(DeregisterRequest{
+			UUID:     cfg.UUID,
+			ClientID: cfg.ClientID,
+		}).Post(deregisterEndpoint)
+
+		if err != nil {
+			return err
+		}
+
+		if !response.IsSuccess() {
+			return fmt.Errorf("server answered %s", response.Status())
+		}
+
+		return nil
+	}
+}
+
+func report(steps []installer.Step) bool {
+	failed := 0
+
+	for _, step := range steps {
+		if step.Err != nil {
+			console.Error(fmt.Sprintf("%s: %s", step.Name, step.Err.Error()))
+			failed++
+			continue
+		}
+		console.Success(step.Name)
+	}
+
+	if failed > 0 {
+		console.Error(fmt.Sprintf("%d of %d steps failed", failed, len(steps)))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/auh-xda/magnesia/console"
+)
+
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Jitter   time.Duration
+	Run      func()
+}
+
+// Start runs every job on its own interval after a random initial delay of
+// up to Jitter, and blocks until ctx is cancelled and in-flight runs finish.
+// A tick that arrives while the previous run of the same job is still going
+// is skipped rather than queued.
+func Start(ctx context.Context, jobs []Job) {
+	var wg sync.WaitGroup
+
+	for _, job := range jobs {
+		if job.Interval <= 0 {
+			console.Warn(fmt.Sprintf("Collector %s has no interval, not scheduling it", job.Name))
+			continue
+		}
+
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			job.loop(ctx, &wg)
+		}(job)
+	}
+
+	wg.Wait()
+}
+
+func (job Job) loop(ctx context.Context, wg *sync.WaitGroup) {
+	var running atomic.Bool
+
+	delay := time.Duration(0)
+	if job.Jitter > 0 {
+		delay = rand.N(job.Jitter)
+	}
+
+	console.Info(fmt.Sprintf("Collector %s every %s, first run in %s", job.Name, job.Interval, delay.Round(time.Second)))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if running.CompareAndSwap(false, true) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer running.Store(false)
+				job.Run()
+			}()
+		} else {
+			console.Warn(fmt.Sprintf("Collector %s is still running, skipping this run", job.Name))
+		}
+
+		timer.Reset(job.Interval)
+	}
+}
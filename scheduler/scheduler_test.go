@@ -0,0 +1,67 @@
+package scheduler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSkipsTicksWhileRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs, finished atomic.Int32
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+
+	job := Job{Name: "slow", Interval: 5 * time.Millisecond, Run: func() {
+		runs.Add(1)
+		started <- struct{}{}
+		<-release
+		finished.Add(1)
+	}}
+
+	stopped := make(chan struct{})
+	go func() {
+		Start(ctx, []Job{job, {Name: "unscheduled", Run: func() { t.Error("job without an interval ran") }}})
+		close(stopped)
+	}()
+
+	waitFor(t, started)
+
+	// several ticks fire while the first run blocks
+	time.Sleep(50 * time.Millisecond)
+	if n := runs.Load(); n != 1 {
+		t.Fatalf("%d runs started while the first was still going, want 1", n)
+	}
+
+	// the next tick after it finishes runs it again
+	release <- struct{}{}
+	waitFor(t, started)
+
+	// cancelling waits for the run in flight
+	cancel()
+	select {
+	case <-stopped:
+		t.Fatal("Start returned before the run in flight finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	waitFor(t, stopped)
+
+	if n := finished.Load(); n != runs.Load() {
+		t.Errorf("%d of %d runs finished after Start returned", n, runs.Load())
+	}
+}
+
+func waitFor[T any](t *testing.T, ch <-chan T) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
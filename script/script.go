@@ -0,0 +1,337 @@
+package script
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+)
+
+const (
+	defaultTimeout    = 5 * time.Minute
+	defaultMax        = time.Hour
+	defaultConcurrent = 4
+	chunkSize         = 16 * 1024
+)
+
+// idPattern is what a job ID may look like. The ID becomes part of a NATS
+// subject and a file name, so dots, wildcards and separators are refused.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Job is a script pushed by the server. Either Script is written to a
+// temporary file and run with Interpreter (the platform shell by default),
+// or Command is executed as-is.
+type Job struct {
+	ID          string            `json:"id"`
+	Script      string            `json:"script,omitempty"`
+	Interpreter []string          `json:"interpreter,omitempty"`
+	Command     []string          `json:"command,omitempty"`
+	Timeout     string            `json:"timeout,omitempty"`
+	Dir         string            `json:"dir,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	User        string            `json:"user,omitempty"`
+}
+
+// Chunk is one piece of output, numbered so the server can order chunks
+// from both streams. Data holds the bytes as read, base64-encoded in JSON,
+// since a read can end in the middle of a UTF-8 character.
+type Chunk struct {
+	ID     string `json:"id"`
+	Seq    int    `json:"seq"`
+	Stream string `json:"stream"`
+	Data   []byte `json:"data"`
+}
+
+// Result is how a job ended. It is the last message on the job subject and
+// is also the reply to the script command.
+type Result struct {
+	ID          string `json:"id"`
+	ExitCode    int    `json:"exit_code"`
+	TimedOut    bool   `json:"timed_out"`
+	DurationMs  int64  `json:"duration_ms"`
+	StdoutBytes int64  `json:"stdout_bytes"`
+	StderrBytes int64  `json:"stderr_bytes"`
+	Error       string `json:"error,omitempty"`
+}
+
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	ID         string    `json:"id"`
+	SHA256     string    `json:"sha256"`
+	Command    []string  `json:"command"`
+	User       string    `json:"user,omitempty"`
+	Dir        string    `json:"dir,omitempty"`
+	ExitCode   int       `json:"exit_code"`
+	TimedOut   bool      `json:"timed_out"`
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var (
+	auditMu   sync.Mutex
+	running   int
+	runningMu sync.Mutex
+)
+
+// ValidID reports whether id can name a job.
+func ValidID(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// Run executes job within the limits from the "scripts" section of
+// config.json, passing output to emit as it is produced. Every run,
+// including refused ones, is appended to the audit log.
+func Run(limits config.Scripts, job Job, emit func(Chunk)) Result {
+	start := time.Now()
+	result := Result{ID: job.ID, ExitCode: -1}
+
+	argv, cleanup, err := prepare(limits, job)
+	defer cleanup()
+
+	if err == nil {
+		var release func()
+		if release, err = acquire(limits); err == nil {
+			err = execute(limits, job, argv, emit, &result)
+			release()
+		}
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+
+	audit(job, argv, result)
+
+	return result
+}
+
+func prepare(limits config.Scripts, job Job) ([]string, func(), error) {
+	cleanup := func() {}
+
+	if !limits.Enabled {
+		return nil, cleanup, fmt.Errorf("script execution is disabled in config")
+	}
+
+	if !ValidID(job.ID) {
+		return nil, cleanup, fmt.Errorf("job id %q must be 1 to 64 letters, digits, '-' or '_'", job.ID)
+	}
+
+	if len(job.Command) > 0 {
+		return job.Command, cleanup, nil
+	}
+
+	if job.Script == "" {
+		return nil, cleanup, fmt.Errorf("job has neither script nor command")
+	}
+
+	interpreter := job.Interpreter
+	if len(interpreter) == 0 {
+		interpreter = defaultInterpreter
+	}
+
+	file, err := os.CreateTemp("", "magnesia-"+job.ID+"-*"+scriptExt)
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("failed to create script file: %v", err)
+	}
+
+	cleanup = func() { _ = os.Remove(file.Name()) }
+
+	if _, err := file.WriteString(job.Script); err != nil {
+		file.Close()
+		return nil, cleanup, fmt.Errorf("failed to write script file: %v", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, cleanup, fmt.Errorf("failed to write script file: %v", err)
+	}
+
+	if err := grant(file.Name(), job.User); err != nil {
+		return nil, cleanup, err
+	}
+
+	return append(append([]string{}, interpreter...), file.Name()), cleanup, nil
+}
+
+func execute(limits config.Scripts, job Job, argv []string, emit func(Chunk), result *Result) error {
+	timeout := clampTimeout(limits, job.Timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = job.Dir
+	cmd.Env = os.Environ()
+	for k, v := range job.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	if err := configure(cmd, job.User); err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	console.Info(fmt.Sprintf("Running script job %s with a %s timeout", job.ID, timeout))
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start: %v", err)
+	}
+
+	var (
+		mu  sync.Mutex
+		seq int
+		wg  sync.WaitGroup
+	)
+
+	stream := func(name string, r io.Reader, total *int64) {
+		defer wg.Done()
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				mu.Lock()
+				seq++
+				*total += int64(n)
+				emit(Chunk{ID: job.ID, Seq: seq, Stream: name, Data: append([]byte{}, buf[:n]...)})
+				mu.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	wg.Add(2)
+	go stream("stdout", stdout, &result.StdoutBytes)
+	go stream("stderr", stderr, &result.StderrBytes)
+	wg.Wait()
+
+	err = cmd.Wait()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		result.TimedOut = true
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	result.ExitCode = 0
+
+	return nil
+}
+
+// acquire takes one of the max_concurrent slots for a script, or fails
+// straight away when all are taken.
+func acquire(limits config.Scripts) (func(), error) {
+	limit := defaultConcurrent
+	if limits.MaxConcurrent > 0 {
+		limit = limits.MaxConcurrent
+	}
+
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	if running >= limit {
+		return nil, fmt.Errorf("%d scripts are already running, the limit is %d", running, limit)
+	}
+
+	running++
+
+	return func() {
+		runningMu.Lock()
+		running--
+		runningMu.Unlock()
+	}, nil
+}
+
+// clampTimeout applies the job timeout, or the configured default, and
+// never lets it exceed max_timeout.
+func clampTimeout(limits config.Scripts, requested string) time.Duration {
+	timeout := defaultTimeout
+	if limits.DefaultTimeout.Duration > 0 {
+		timeout = limits.DefaultTimeout.Duration
+	}
+	if d, err := time.ParseDuration(requested); err == nil && d > 0 {
+		timeout = d
+	}
+
+	max := defaultMax
+	if limits.MaxTimeout.Duration > 0 {
+		max = limits.MaxTimeout.Duration
+	}
+
+	return min(timeout, max)
+}
+
+// audit appends one line per execution to audit.log in the config
+// directory.
+func audit(job Job, argv []string, result Result) {
+	sum := sha256.Sum256([]byte(job.Script))
+	if len(job.Command) > 0 {
+		b, _ := json.Marshal(job.Command)
+		sum = sha256.Sum256(b)
+	}
+
+	entry := auditEntry{
+		Time:       time.Now().UTC(),
+		ID:         job.ID,
+		SHA256:     hex.EncodeToString(sum[:]),
+		Command:    argv,
+		User:       job.User,
+		Dir:        job.Dir,
+		ExitCode:   result.ExitCode,
+		TimedOut:   result.TimedOut,
+		DurationMs: result.DurationMs,
+		Error:      result.Error,
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if err := os.MkdirAll(config.Dir(), 0755); err != nil {
+		console.Error("Error writing script audit log: " + err.Error())
+		return
+	}
+
+	f, err := os.OpenFile(filepath.Join(config.Dir(), "audit.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		console.Error("Error writing script audit log: " + err.Error())
+		return
+	}
+	defer f.Close()
+
+	_, _ = f.Write(append(line, '\n'))
+}
@@ -0,0 +1,153 @@
+package script
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/auh-xda/magnesia/config"
+)
+
+func TestValidID(t *testing.T) {
+	tests := []struct {
+		id string
+		ok bool
+	}{
+		{"job-42", true},
+		{"JOB_42", true},
+		{strings.Repeat("a", 64), true},
+		{"", false},
+		{strings.Repeat("a", 65), false},
+		{"a.b", false},
+		{"a*", false},
+		{"a>", false},
+		{"../etc", false},
+		{"a b", false},
+		{"é", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidID(tt.id); got != tt.ok {
+			t.Errorf("ValidID(%q) = %v, want %v", tt.id, got, tt.ok)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	enabled := config.Scripts{Enabled: true, MaxConcurrent: 2}
+
+	// 20000 bytes of "é" are read in 16 KiB pieces, so one ends mid-character
+	accents := strings.Repeat("é", 10000)
+
+	tests := []struct {
+		name     string
+		limits   config.Scripts
+		job      Job
+		exitCode int
+		stdout   string
+		wantErr  string
+	}{
+		{"disabled", config.Scripts{}, Job{ID: "a", Command: []string{"true"}}, -1, "", "disabled"},
+		{"invalid id", enabled, Job{ID: "a.b", Command: []string{"true"}}, -1, "", "job id"},
+		{"no work", enabled, Job{ID: "a"}, -1, "", "neither script nor command"},
+		{"command", enabled, Job{ID: "a", Command: []string{"echo", "hi"}}, 0, "hi\n", ""},
+		{"script", enabled, Job{ID: "a", Script: "echo out; echo err >&2; exit 3"}, 3, "out\n", ""},
+		{"split characters", enabled, Job{ID: "a", Command: []string{"printf", "%s", accents}}, 0, accents, ""},
+		{"timeout", enabled, Job{ID: "a", Command: []string{"sleep", "5"}, Timeout: "100ms"}, -1, "", "timed out"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			result := Run(tt.limits, tt.job, func(c Chunk) {
+				if c.Stream == "stdout" {
+					stdout.Write(c.Data)
+				}
+			})
+
+			if tt.wantErr != "" {
+				if !strings.Contains(result.Error, tt.wantErr) {
+					t.Errorf("error = %q, want %q", result.Error, tt.wantErr)
+				}
+				return
+			}
+
+			if result.Error != "" {
+				t.Fatalf("error = %q", result.Error)
+			}
+			if result.ExitCode != tt.exitCode {
+				t.Errorf("exit code = %d, want %d", result.ExitCode, tt.exitCode)
+			}
+			if stdout.String() != tt.stdout {
+				t.Errorf("stdout = %d bytes, want %d", stdout.Len(), len(tt.stdout))
+			}
+			if !utf8.Valid(stdout.Bytes()) {
+				t.Error("reassembled output is not valid UTF-8")
+			}
+		})
+	}
+}
+
+func TestChunkDataIsBase64(t *testing.T) {
+	data, err := json.Marshal(Chunk{ID: "a", Seq: 1, Stream: "stdout", Data: []byte{0xc3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{"id":"a","seq":1,"stream":"stdout","data":"ww=="}`; string(data) != want {
+		t.Errorf("chunk = %s, want %s", data, want)
+	}
+}
+
+func TestRunLimitsConcurrency(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	limits := config.Scripts{Enabled: true, MaxConcurrent: 2}
+
+	results := make([]Result, 4)
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = Run(limits, Job{ID: "slow", Command: []string{"sleep", "0.5"}}, func(Chunk) {})
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+
+	ran, refused := 0, 0
+	for _, r := range results {
+		switch {
+		case r.Error == "":
+			ran++
+		case strings.Contains(r.Error, "already running"):
+			refused++
+		default:
+			t.Errorf("unexpected error %q", r.Error)
+		}
+	}
+
+	if ran != 2 || refused != 2 {
+		t.Errorf("%d ran and %d were refused, want 2 and 2", ran, refused)
+	}
+
+	// slots are given back when jobs end
+	if r := Run(limits, Job{ID: "after", Command: []string{"true"}}, func(Chunk) {}); r.Error != "" {
+		t.Errorf("job after the others ended: %s", r.Error)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+// +build !windows
+
+package script
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+const scriptExt = ".sh"
+
+var defaultInterpreter = []string{"/bin/sh"}
+
+// configure runs the job in its own process group, so a timeout also kills
+// anything the script spawned, and drops to the requested user.
+func configure(cmd *exec.Cmd, username string) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	if username == "" {
+		return nil
+	}
+
+	uid, gid, err := lookup(username)
+	if err != nil {
+		return err
+	}
+
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+
+	return nil
+}
+
+// grant lets the run-as user read the temporary script file.
+func grant(path, username string) error {
+	if username == "" {
+		return nil
+	}
+
+	uid, gid, err := lookup(username)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chown(path, int(uid), int(gid)); err != nil {
+		return fmt.Errorf("failed to hand script to %s: %v", username, err)
+	}
+
+	return nil
+}
+
+func lookup(username string) (uint32, uint32, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unknown user %s: %v", username, err)
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid uid for %s: %v", username, err)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid gid for %s: %v", username, err)
+	}
+
+	return uint32(uid), uint32(gid), nil
+}
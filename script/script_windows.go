@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package script
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+const scriptExt = ".ps1"
+
+var defaultInterpreter = []string{"powershell.exe", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File"}
+
+func configure(cmd *exec.Cmd, username string) error {
+	if username != "" {
+		return fmt.Errorf("running scripts as another user is not supported on windows")
+	}
+
+	return nil
+}
+
+func grant(path, username string) error {
+	return nil
+}
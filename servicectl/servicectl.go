@@ -0,0 +1,92 @@
+package servicectl
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/installer"
+)
+
+const controlTimeout = 90 * time.Second
+
+type State struct {
+	Name          string `json:"name"`
+	Status        string `json:"status"`
+	ActiveState   string `json:"active_state"`
+	SubState      string `json:"sub_state"`
+	UnitFileState string `json:"unit_file_state"`
+}
+
+var actions = map[string]bool{
+	"start":   true,
+	"stop":    true,
+	"restart": true,
+	"enable":  true,
+	"disable": true,
+}
+
+// Control applies action to the named service once the "service_control"
+// rules in config.json allow it, and returns the state the service ended
+// up in.
+func Control(rules config.ServiceControl, action, name string) (State, error) {
+	if !actions[action] {
+		return State{}, fmt.Errorf("unknown service action %q, expected start, stop, restart, enable or disable", action)
+	}
+
+	if name == "" {
+		return State{}, fmt.Errorf("no service name given")
+	}
+
+	if err := Allowed(rules, name); err != nil {
+		return State{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+
+	console.Info(fmt.Sprintf("Running %s on service %s", action, name))
+
+	return control(ctx, action, name)
+}
+
+// Allowed refuses the agent's own service, then checks name against the
+// deny list and the allow list. Nothing is allowed until the allow list
+// names it. Patterns use path.Match syntax and are compared with and
+// without the ".service" suffix.
+func Allowed(rules config.ServiceControl, name string) error {
+	short := strings.TrimSuffix(name, ".service")
+
+	if short == installer.ServiceName {
+		return fmt.Errorf("service %s runs this agent and cannot be controlled through it", name)
+	}
+
+	if matchAny(rules.Deny, name, short) {
+		return fmt.Errorf("service %s is denied by service_control rules", name)
+	}
+
+	if len(rules.Allow) == 0 {
+		return fmt.Errorf("service control is disabled, list the services it may manage in service_control.allow")
+	}
+
+	if !matchAny(rules.Allow, name, short) {
+		return fmt.Errorf("service %s is not in the service_control allow list", name)
+	}
+
+	return nil
+}
+
+func matchAny(patterns []string, names ...string) bool {
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+package servicectl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+)
+
+// control talks to systemd over the system bus and waits for the queued
+// job to finish before reading back the unit state.
+func control(ctx context.Context, action, name string) (State, error) {
+	unit := name
+	if !strings.Contains(unit, ".") {
+		unit += ".service"
+	}
+
+	conn, err := dbus.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return State{}, fmt.Errorf("failed to connect to systemd: %v", err)
+	}
+	defer conn.Close()
+
+	switch action {
+	case "start", "stop", "restart":
+		if err := runJob(ctx, conn, action, unit); err != nil {
+			return State{}, err
+		}
+
+	case "enable":
+		if _, _, err := conn.EnableUnitFilesContext(ctx, []string{unit}, false, true); err != nil {
+			return State{}, fmt.Errorf("failed to enable %s: %v", unit, err)
+		}
+		if err := conn.ReloadContext(ctx); err != nil {
+			return State{}, fmt.Errorf("daemon-reload failed: %v", err)
+		}
+
+	case "disable":
+		if _, err := conn.DisableUnitFilesContext(ctx, []string{unit}, false); err != nil {
+			return State{}, fmt.Errorf("failed to disable %s: %v", unit, err)
+		}
+		if err := conn.ReloadContext(ctx); err != nil {
+			return State{}, fmt.Errorf("daemon-reload failed: %v", err)
+		}
+	}
+
+	return unitState(ctx, conn, unit)
+}
+
+func runJob(ctx context.Context, conn *dbus.Conn, action, unit string) error {
+	done := make(chan string, 1)
+
+	var err error
+	switch action {
+	case "start":
+		_, err = conn.StartUnitContext(ctx, unit, "replace", done)
+	case "stop":
+		_, err = conn.StopUnitContext(ctx, unit, "replace", done)
+	case "restart":
+		_, err = conn.RestartUnitContext(ctx, unit, "replace", done)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to %s %s: %v", action, unit, err)
+	}
+
+	select {
+	case result := <-done:
+		if result != "done" {
+			return fmt.Errorf("%s of %s finished with result %q", action, unit, result)
+		}
+		return nil
+
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for %s of %s", action, unit)
+	}
+}
+
+func unitState(ctx context.Context, conn *dbus.Conn, unit string) (State, error) {
+	props, err := conn.GetUnitPropertiesContext(ctx, unit)
+	if err != nil {
+		return State{}, fmt.Errorf("failed to read state of %s: %v", unit, err)
+	}
+
+	state := State{Name: strings.TrimSuffix(unit, ".service")}
+
+	state.ActiveState, _ = props["ActiveState"].(string)
+	state.SubState, _ = props["SubState"].(string)
+	state.UnitFileState, _ = props["UnitFileState"].(string)
+
+	state.Status = "stopped"
+	if state.ActiveState == "active" {
+		state.Status = "running"
+	}
+
+	return state, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package servicectl
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+func control(ctx context.Context, action, name string) (State, error) {
+	return State{}, fmt.Errorf("service control is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,42 @@
+package servicectl
+
+import (
+	"testing"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/installer"
+)
+
+func TestAllowed(t *testing.T) {
+	rules := config.ServiceControl{
+		Allow: []string{"nginx", "php*-fpm", "*"},
+		Deny:  []string{"sshd"},
+	}
+
+	tests := []struct {
+		name  string
+		rules config.ServiceControl
+		unit  string
+		ok    bool
+	}{
+		{"no rules", config.ServiceControl{}, "nginx", false},
+		{"deny only", config.ServiceControl{Deny: []string{"sshd"}}, "nginx", false},
+		{"allowed", rules, "nginx", true},
+		{"allowed with suffix", rules, "nginx.service", true},
+		{"allowed by glob", rules, "php8.2-fpm.service", true},
+		{"denied wins over allow", rules, "sshd", false},
+		{"denied with suffix", rules, "sshd.service", false},
+		{"not listed", config.ServiceControl{Allow: []string{"nginx"}}, "cron", false},
+		{"agent itself", rules, installer.ServiceName, false},
+		{"agent itself with suffix", rules, installer.ServiceName + ".service", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Allowed(tt.rules, tt.unit)
+			if (err == nil) != tt.ok {
+				t.Errorf("Allowed(%s) = %v, want ok = %v", tt.unit, err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Operation is a single RFC 6902 JSON Patch operation. Applying the
+// operations of a delta in order to the previous payload yields the new one.
+type Operation struct {
+	Op    string `json:"op"`
+	From  string `json:"from,omitempty"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// MarshalJSON writes only the members each op takes, and keeps "value" on
+// add and replace even when it is null, which omitempty alone would drop.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	switch o.Op {
+	case "move":
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			From string `json:"from"`
+			Path string `json:"path"`
+		}{o.Op, o.From, o.Path})
+
+	case "remove":
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{o.Op, o.Path})
+	}
+
+	return json.Marshal(struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value any    `json:"value"`
+	}{o.Op, o.Path, o.Value})
+}
+
+// arrayKeys names the field that identifies an element of an array, per
+// payload type and array location ("" is the payload root, "/*" steps into
+// an element). Matching on it lets one changed process or service produce a
+// single operation instead of resending the whole array. The first key
+// present and unique in every element is used; a key such as
+// "name+version" combines fields, of which only the first must be present.
+// Arrays not listed here, or whose keys are missing or duplicated, are
+// replaced whole.
+var arrayKeys = map[string]map[string][]string{
+	"processlist": {"": {"pid"}},
+	"services":    {"": {"name", "label"}},
+	// rpm lists every installed kernel under one name, and Windows lists
+	// 32 and 64 bit builds of a program separately
+	"installations": {"": {"name", "name+version", "name+version+install_location"}},
+	"intercept": {
+		"/disks":      {"mountpoint"},
+		"/interfaces": {"name"},
+	},
+}
+
+func DeepDiff(payloadType string, oldData, newData any) ([]Operation, error) {
+	oldNorm, err := normalize(oldData)
+	if err != nil {
+		return nil, err
+	}
+	newNorm, err := normalize(newData)
+	if err != nil {
+		return nil, err
+	}
+
+	d := differ{keys: arrayKeys[payloadType]}
+	d.diff(oldNorm, newNorm, "", "")
+
+	return d.ops, nil
+}
+
+func normalize(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type differ struct {
+	keys map[string][]string
+	ops  []Operation
+}
+
+// diff appends the operations turning old into new at path. schema is path
+// with array positions replaced by "*", used to look up array keys.
+func (d *differ) diff(old, new any, path, schema string) {
+	switch oldTyped := old.(type) {
+	case map[string]any:
+		newTyped, ok := new.(map[string]any)
+		if !ok {
+			d.replace(path, new)
+			return
+		}
+
+		for _, k := range sortedKeys(oldTyped) {
+			if _, exists := newTyped[k]; !exists {
+				d.ops = append(d.ops, Operation{Op: "remove", Path: path + "/" + escape(k)})
+			}
+		}
+
+		for _, k := range sortedKeys(newTyped) {
+			newVal := newTyped[k]
+			if oldVal, exists := oldTyped[k]; !exists {
+				d.ops = append(d.ops, Operation{Op: "add", Path: path + "/" + escape(k), Value: newVal})
+			} else {
+				d.diff(oldVal, newVal, path+"/"+escape(k), schema+"/"+escape(k))
+			}
+		}
+
+	case []any:
+		newTyped, ok := new.([]any)
+		if !ok {
+			d.replace(path, new)
+			return
+		}
+
+		if key := keyField(d.keys[schema], oldTyped, newTyped); key != "" {
+			d.diffKeyed(oldTyped, newTyped, key, path, schema)
+			return
+		}
+
+		if !reflect.DeepEqual(oldTyped, newTyped) {
+			d.replace(path, new)
+		}
+
+	default:
+		if !reflect.DeepEqual(old, new) {
+			d.replace(path, new)
+		}
+	}
+}
+
+// diffKeyed matches elements by key and leaves them in the order of new,
+// so index paths in later deltas point at the same elements on both sides.
+// Elements gone from new are removed, highest index first so earlier
+// indexes stay valid. The survivors are then walked in the order of new:
+// each is moved into place if it is not there yet and diffed at its index,
+// and new elements are added where they belong.
+func (d *differ) diffKeyed(old, new []any, key, path, schema string) {
+	newKeys := make(map[string]bool, len(new))
+	for _, el := range new {
+		newKeys[keyOf(el, key)] = true
+	}
+
+	for i := len(old) - 1; i >= 0; i-- {
+		if !newKeys[keyOf(old[i], key)] {
+			d.ops = append(d.ops, Operation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+	}
+
+	current := make([]any, 0, len(new))
+	for _, el := range old {
+		if newKeys[keyOf(el, key)] {
+			current = append(current, el)
+		}
+	}
+
+	for i, el := range new {
+		at := path + "/" + strconv.Itoa(i)
+		k := keyOf(el, key)
+
+		from := -1
+		for j := i; j < len(current); j++ {
+			if keyOf(current[j], key) == k {
+				from = j
+				break
+			}
+		}
+
+		if from < 0 {
+			d.ops = append(d.ops, Operation{Op: "add", Path: at, Value: el})
+			current = slices.Insert(current, i, el)
+			continue
+		}
+
+		if from != i {
+			d.ops = append(d.ops, Operation{Op: "move", From: path + "/" + strconv.Itoa(from), Path: at})
+			moved := current[from]
+			current = slices.Insert(slices.Delete(current, from, from+1), i, moved)
+		}
+
+		d.diff(current[i], el, at, schema+"/*")
+	}
+}
+
+func (d *differ) replace(path string, value any) {
+	d.ops = append(d.ops, Operation{Op: "replace", Path: path, Value: value})
+}
+
+// keyField returns the first candidate present and unique in every element
+// of both arrays, or "" when the arrays cannot be matched by key.
+func keyField(candidates []string, arrays ...[]any) string {
+	for _, candidate := range candidates {
+		if uniqueKey(candidate, arrays...) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func uniqueKey(key string, arrays ...[]any) bool {
+	for _, arr := range arrays {
+		seen := make(map[string]bool, len(arr))
+		for _, el := range arr {
+			obj, ok := el.(map[string]any)
+			if !ok || obj[strings.Split(key, "+")[0]] == nil {
+				return false
+			}
+			k := keyOf(el, key)
+			if seen[k] {
+				return false
+			}
+			seen[k] = true
+		}
+	}
+	return true
+}
+
+func keyOf(el any, key string) string {
+	obj := el.(map[string]any)
+
+	var parts []string
+	for _, field := range strings.Split(key, "+") {
+		parts = append(parts, fmt.Sprint(obj[field]))
+	}
+
+	return strings.Join(parts, "\x00")
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escape encodes a map key as a JSON Pointer reference token (RFC 6901).
+func escape(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
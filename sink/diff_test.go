@@ -0,0 +1,337 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDeepDiffRoundTrip(t *testing.T) {
+	proc := func(pid int, name string, cpu float64) map[string]any {
+		return map[string]any{"pid": pid, "name": name, "cpu": cpu}
+	}
+	pkg := func(name, version, location string) map[string]any {
+		return map[string]any{"name": name, "version": version, "install_location": location}
+	}
+
+	tests := []struct {
+		name        string
+		payloadType string
+		old, new    any
+	}{
+		{"unchanged", "processlist", []any{proc(1, "init", 0)}, []any{proc(1, "init", 0)}},
+		{"object keys", "power", map[string]any{"a": 1, "b": 2, "x/y": 3, "m~n": 4}, map[string]any{"b": 3, "c": nil, "x/y": 4}},
+		{"nested object", "intercept", map[string]any{"host": map[string]any{"name": "a", "os": "linux"}}, map[string]any{"host": map[string]any{"name": "b"}}},
+		{"type change", "power", map[string]any{"a": []any{1}}, map[string]any{"a": "x"}},
+		{"root type change", "power", []any{1, 2}, map[string]any{"a": 1}},
+		{"unkeyed array", "power", map[string]any{"a": []any{1, 2, 3}}, map[string]any{"a": []any{3, 1}}},
+		{
+			"keyed change in place", "processlist",
+			[]any{proc(1, "init", 0), proc(2, "sshd", 0.1), proc(3, "bash", 0)},
+			[]any{proc(1, "init", 0), proc(2, "sshd", 2.5), proc(3, "bash", 0)},
+		},
+		{
+			"keyed remove then insert in the middle", "processlist",
+			[]any{proc(1, "init", 0), proc(2, "sshd", 0), proc(3, "bash", 0), proc(4, "vim", 0)},
+			[]any{proc(1, "init", 0), proc(5, "top", 0), proc(3, "bash", 1), proc(4, "vim", 0), proc(6, "less", 0)},
+		},
+		{
+			"keyed insert at the front", "processlist",
+			[]any{proc(2, "sshd", 0), proc(3, "bash", 0)},
+			[]any{proc(1, "init", 0), proc(2, "sshd", 0), proc(3, "bash", 0)},
+		},
+		{
+			"keyed reorder", "processlist",
+			[]any{proc(1, "a", 0), proc(2, "b", 0), proc(3, "c", 0), proc(4, "d", 0)},
+			[]any{proc(4, "d", 1), proc(2, "b", 0), proc(1, "a", 0), proc(3, "c", 0)},
+		},
+		{
+			"keyed remove everything", "processlist",
+			[]any{proc(1, "a", 0), proc(2, "b", 0)},
+			[]any{},
+		},
+		{
+			"keyed from empty", "processlist",
+			[]any{},
+			[]any{proc(1, "a", 0), proc(2, "b", 0)},
+		},
+		{
+			"duplicate keys fall back to replace", "processlist",
+			[]any{proc(1, "a", 0), proc(1, "b", 0)},
+			[]any{proc(1, "a", 0)},
+		},
+		{
+			"installations with duplicate names", "installations",
+			[]any{pkg("kernel", "6.1", ""), pkg("kernel", "6.2", ""), pkg("bash", "5.2", "")},
+			[]any{pkg("kernel", "6.2", ""), pkg("kernel", "6.3", ""), pkg("bash", "5.2", "")},
+		},
+		{
+			"installations with duplicate names and versions", "installations",
+			[]any{pkg("Runtime", "14.0", `C:\x86`), pkg("Runtime", "14.0", `C:\x64`)},
+			[]any{pkg("Runtime", "14.0", `C:\x64`), pkg("Runtime", "14.1", `C:\x86`)},
+		},
+		{
+			"services keyed on label when name is missing", "services",
+			[]any{map[string]any{"label": "com.a", "pid": 1}, map[string]any{"label": "com.b", "pid": 2}},
+			[]any{map[string]any{"label": "com.b", "pid": 3}, map[string]any{"label": "com.c", "pid": 4}},
+		},
+		{
+			"nested keyed arrays", "intercept",
+			map[string]any{
+				"disks":      []any{map[string]any{"mountpoint": "/", "used": 1}, map[string]any{"mountpoint": "/home", "used": 2}},
+				"interfaces": []any{map[string]any{"name": "eth0"}, map[string]any{"name": "lo"}},
+			},
+			map[string]any{
+				"disks":      []any{map[string]any{"mountpoint": "/boot", "used": 0}, map[string]any{"mountpoint": "/", "used": 5}},
+				"interfaces": []any{map[string]any{"name": "lo"}, map[string]any{"name": "wlan0"}, map[string]any{"name": "eth0", "up": false}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := DeepDiff(tt.payloadType, tt.old, tt.new)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// go through JSON as the server would
+			data, err := json.Marshal(ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sent []map[string]any
+			if err := json.Unmarshal(data, &sent); err != nil {
+				t.Fatal(err)
+			}
+
+			doc, _ := normalize(tt.old)
+			got, err := applyPatch(doc, sent)
+			if err != nil {
+				t.Fatalf("applying %s: %v", data, err)
+			}
+
+			want, _ := normalize(tt.new)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("apply(diff(old, new), old) != new\npatch: %s\n  got: %v\n want: %v", data, got, want)
+			}
+		})
+	}
+}
+
+func TestDeepDiffKeyedIsMinimal(t *testing.T) {
+	old := []any{
+		map[string]any{"pid": 1, "cpu": 0},
+		map[string]any{"pid": 2, "cpu": 0},
+		map[string]any{"pid": 3, "cpu": 0},
+	}
+	new := []any{
+		map[string]any{"pid": 1, "cpu": 0},
+		map[string]any{"pid": 3, "cpu": 7},
+	}
+
+	ops, err := DeepDiff("processlist", old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Operation{
+		{Op: "remove", Path: "/1"},
+		{Op: "replace", Path: "/1/cpu", Value: float64(7)},
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("ops = %+v, want %+v", ops, want)
+	}
+}
+
+func TestDeepDiffDuplicateNames(t *testing.T) {
+	kernel := func(version string, size int) map[string]any {
+		return map[string]any{"name": "kernel", "version": version, "estimated_size": size}
+	}
+
+	old := []any{kernel("6.1", 1), kernel("6.2", 2), map[string]any{"name": "bash"}}
+	new := []any{kernel("6.1", 1), kernel("6.2", 3), map[string]any{"name": "bash"}}
+
+	ops, err := DeepDiff("installations", old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Operation{{Op: "replace", Path: "/1/estimated_size", Value: float64(3)}}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("ops = %+v, want %+v", ops, want)
+	}
+}
+
+func TestOperationMarshalJSON(t *testing.T) {
+	tests := []struct {
+		op   Operation
+		want string
+	}{
+		{Operation{Op: "add", Path: "/a", Value: nil}, `{"op":"add","path":"/a","value":null}`},
+		{Operation{Op: "replace", Path: "/a", Value: 1}, `{"op":"replace","path":"/a","value":1}`},
+		{Operation{Op: "remove", Path: "/a", Value: 1}, `{"op":"remove","path":"/a"}`},
+		{Operation{Op: "move", From: "/2", Path: "/0"}, `{"op":"move","from":"/2","path":"/0"}`},
+	}
+
+	for _, tt := range tests {
+		got, err := json.Marshal(tt.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s = %s, want %s", tt.op.Op, got, tt.want)
+		}
+	}
+}
+
+// applyPatch is a minimal RFC 6902 implementation of the operations the
+// differ emits, standing in for the server.
+func applyPatch(doc any, ops []map[string]any) (any, error) {
+	for _, op := range ops {
+		path, _ := op["path"].(string)
+
+		var err error
+		switch op["op"] {
+		case "add":
+			doc, err = update(doc, path, func(parent any, token string) (any, error) {
+				return insert(parent, token, op["value"])
+			})
+
+		case "remove":
+			doc, err = update(doc, path, remove)
+
+		case "replace":
+			if path == "" {
+				doc = op["value"]
+				continue
+			}
+			doc, err = update(doc, path, func(parent any, token string) (any, error) {
+				if parent, err = remove(parent, token); err != nil {
+					return nil, err
+				}
+				return insert(parent, token, op["value"])
+			})
+
+		case "move":
+			var value any
+			from, _ := op["from"].(string)
+			doc, err = update(doc, from, func(parent any, token string) (any, error) {
+				value, err = lookup(parent, token)
+				if err != nil {
+					return nil, err
+				}
+				return remove(parent, token)
+			})
+			if err == nil {
+				doc, err = update(doc, path, func(parent any, token string) (any, error) {
+					return insert(parent, token, value)
+				})
+			}
+
+		default:
+			err = fmt.Errorf("unsupported op %v", op["op"])
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%v %s: %v", op["op"], path, err)
+		}
+	}
+
+	return doc, nil
+}
+
+// update calls leaf with the container holding the last token of path and
+// stores what it returns in its place.
+func update(doc any, path string, leaf func(parent any, token string) (any, error)) (any, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid pointer %q", path)
+	}
+
+	tokens := strings.Split(path[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+
+	var walk func(node any, tokens []string) (any, error)
+	walk = func(node any, tokens []string) (any, error) {
+		if len(tokens) == 1 {
+			return leaf(node, tokens[0])
+		}
+
+		child, err := lookup(node, tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		if child, err = walk(child, tokens[1:]); err != nil {
+			return nil, err
+		}
+
+		switch n := node.(type) {
+		case map[string]any:
+			n[tokens[0]] = child
+		case []any:
+			i, _ := strconv.Atoi(tokens[0])
+			n[i] = child
+		}
+		return node, nil
+	}
+
+	return walk(doc, tokens)
+}
+
+func lookup(node any, token string) (any, error) {
+	switch n := node.(type) {
+	case map[string]any:
+		v, ok := n[token]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", token)
+		}
+		return v, nil
+	case []any:
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(n) {
+			return nil, fmt.Errorf("index %q out of range", token)
+		}
+		return n[i], nil
+	}
+	return nil, fmt.Errorf("cannot step into %T", node)
+}
+
+func insert(node any, token string, value any) (any, error) {
+	switch n := node.(type) {
+	case map[string]any:
+		n[token] = value
+		return n, nil
+	case []any:
+		if token == "-" {
+			return append(n, value), nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i > len(n) {
+			return nil, fmt.Errorf("index %q out of range", token)
+		}
+		return slices.Insert(n, i, value), nil
+	}
+	return nil, fmt.Errorf("cannot add to %T", node)
+}
+
+func remove(node any, token string) (any, error) {
+	if _, err := lookup(node, token); err != nil {
+		return nil, err
+	}
+
+	switch n := node.(type) {
+	case map[string]any:
+		delete(n, token)
+		return n, nil
+	case []any:
+		i, _ := strconv.Atoi(token)
+		return slices.Delete(n, i, i+1), nil
+	}
+	return nil, fmt.Errorf("cannot remove from %T", node)
+}
@@ -0,0 +1,43 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/auh-xda/magnesia/config"
+)
+
+// fileSink appends each envelope to a local NDJSON file, one per line.
+// Envelopes may hold inventory an operator chose not to share, so the file
+// is readable by its owner only.
+type fileSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newFile(_ string, settings config.Sink) (Sink, error) {
+	if err := os.MkdirAll(filepath.Dir(settings.Path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %v", settings.Path, err)
+	}
+
+	return &fileSink{path: settings.Path}, nil
+}
+
+func (s *fileSink) Send(_ string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data[:len(data):len(data)], '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
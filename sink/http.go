@@ -0,0 +1,59 @@
+package sink
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/auh-xda/magnesia/client"
+	"github.com/auh-xda/magnesia/compression"
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+)
+
+// httpSink posts each envelope to Momentum, or to any URL, as a signed
+// request. A compressed body is marked with Content-Encoding; a server that
+// answers 415 Unsupported Media Type gets plain JSON from then on.
+type httpSink struct {
+	name        string
+	url         string
+	compression config.Compression
+	plain       atomic.Bool
+}
+
+func newHTTP(name string, settings config.Sink) (Sink, error) {
+	return &httpSink{name: name, url: settings.URL, compression: settings.Compression}, nil
+}
+
+func (s *httpSink) Send(_ string, data []byte) error {
+	body, algorithm := data, compression.None
+
+	if !s.plain.Load() {
+		var err error
+		if body, algorithm, err = compress(s.name, s.compression, data); err != nil {
+			return err
+		}
+	}
+
+	headers := map[string]string{}
+	if algorithm != compression.None {
+		headers[compression.Header] = algorithm
+	}
+
+	response, err := client.PostWithHeaders(s.url, body, headers)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode() == http.StatusUnsupportedMediaType && algorithm != compression.None {
+		console.Warn(fmt.Sprintf("%s does not accept %s bodies, sending %s uncompressed", s.url, algorithm, s.name))
+		s.plain.Store(true)
+		return s.Send("", data)
+	}
+
+	if response.IsError() {
+		return fmt.Errorf("%s answered %s", s.url, response.Status())
+	}
+
+	return nil
+}
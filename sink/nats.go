@@ -0,0 +1,257 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/auh-xda/magnesia/chunk"
+	"github.com/auh-xda/magnesia/compression"
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/nats"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	ackWait = 5 * time.Second
+
+	// defaultDuplicates is the duplicate window NATS gives a stream unless
+	// configured otherwise
+	defaultDuplicates = 2 * time.Minute
+
+	// chunkHeadroom leaves room under max_payload for the headers, which
+	// NATS counts against the limit too
+	chunkHeadroom = 1024
+)
+
+// natsSink publishes on the agent's shared NATS connection. In JetStream
+// mode every envelope waits for the stream's acknowledgement, and carries
+// a message ID so the stream drops the copies a retry or replay sends.
+// Compressed envelopes name their algorithm in the Content-Encoding header,
+// and envelopes above the server's max_payload are sent in chunks.
+type natsSink struct {
+	name        string
+	jetStream   bool
+	compression config.Compression
+	streams     *streams
+}
+
+// streams is the JetStream context of the current connection and the
+// duplicate window of each subject published to, both looked up once.
+type streams struct {
+	mu      sync.Mutex
+	conn    *natsgo.Conn
+	js      jetstream.JetStream
+	windows map[string]time.Duration
+}
+
+func newNATS(name string, settings config.Sink) (Sink, error) {
+	s := natsSink{name: name, jetStream: settings.JetStream, compression: settings.Compression, streams: &streams{}}
+
+	replayOnConnect(name, func(replay func()) {
+		nats.OnConnect(func(*natsgo.Conn) { replay() })
+	})
+
+	return s, nil
+}
+
+func (natsSink) Online() bool {
+	nc, err := nats.Connection()
+
+	return err == nil && nc.IsConnected()
+}
+
+func (s natsSink) Send(subject string, data []byte) error {
+	if err := s.Publish(subject, data); err != nil {
+		return err
+	}
+	return s.Flush()
+}
+
+func (s natsSink) Publish(subject string, data []byte) error {
+	nc, err := nats.Connection()
+	if err != nil {
+		return err
+	}
+	if !nc.IsConnected() {
+		return ErrOffline
+	}
+
+	body, algorithm, err := compress(s.name, s.compression, data)
+	if err != nil {
+		return err
+	}
+
+	parts := chunk.Split(body, int(nc.MaxPayload())-chunkHeadroom)
+
+	var id string
+	if s.jetStream || len(parts) > 1 {
+		if id, err = messageID(data); err != nil {
+			return err
+		}
+	}
+
+	if len(parts) > 1 {
+		console.Info(fmt.Sprintf("Splitting %d byte envelope %s into %d chunks", len(body), id, len(parts)))
+	}
+
+	for i, part := range parts {
+		msg := natsgo.NewMsg(subject)
+		msg.Data = part
+
+		if algorithm != compression.None {
+			msg.Header.Set(compression.Header, algorithm)
+		}
+
+		msgID := id
+		if len(parts) > 1 {
+			msg.Header.Set(chunk.IDHeader, id)
+			msg.Header.Set(chunk.IndexHeader, strconv.Itoa(i))
+			msg.Header.Set(chunk.CountHeader, strconv.Itoa(len(parts)))
+			msgID = fmt.Sprintf("%s.%d", id, i)
+		}
+
+		if !s.jetStream {
+			if err := nc.PublishMsg(msg); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := s.publishAcked(nc, msg, msgID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishAcked publishes msg to JetStream under msgID and waits for the
+// stream to store it. A lost acknowledgement is retried with the same ID
+// for as long as the stream would drop the copy as a duplicate; after
+// that ErrUnacknowledged sends the envelope to the spool.
+func (s natsSink) publishAcked(nc *natsgo.Conn, msg *natsgo.Msg, msgID string) error {
+	js, err := s.streams.get(nc)
+	if err != nil {
+		return err
+	}
+
+	window := s.streams.window(js, msg.Subject)
+	deadline := time.Now().Add(window)
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), ackWait)
+		ack, err := js.PublishMsg(ctx, msg, jetstream.WithMsgID(msgID))
+		cancel()
+
+		if err == nil {
+			if ack.Duplicate {
+				console.Info(fmt.Sprintf("Stream %s already holds %s", ack.Stream, msgID))
+			}
+			return nil
+		}
+
+		if !nc.IsConnected() {
+			return ErrOffline
+		}
+
+		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, natsgo.ErrTimeout) {
+			return fmt.Errorf("no acknowledgement from JetStream: %v", err)
+		}
+
+		if time.Now().Add(ackWait).After(deadline) {
+			return fmt.Errorf("%w by JetStream within its %s duplicate window", ErrUnacknowledged, window)
+		}
+
+		console.Warn(fmt.Sprintf("No acknowledgement for %s, publishing it again", msgID))
+	}
+}
+
+// get returns the JetStream context of nc, made once per connection.
+func (s *streams) get(nc *natsgo.Conn) (jetstream.JetStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nc {
+		return s.js, nil
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+
+	s.conn, s.js, s.windows = nc, js, map[string]time.Duration{}
+
+	return js, nil
+}
+
+// window is the duplicate window of the stream that stores subject. The
+// NATS default is assumed when the agent may not look the stream up.
+func (s *streams) window(js jetstream.JetStream, subject string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if window, ok := s.windows[subject]; ok {
+		return window
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ackWait)
+	defer cancel()
+
+	name, err := js.StreamNameBySubject(ctx, subject)
+	if err != nil {
+		return defaultDuplicates
+	}
+
+	stream, err := js.Stream(ctx, name)
+	if err != nil {
+		return defaultDuplicates
+	}
+
+	window := stream.CachedInfo().Config.Duplicates
+	if window <= 0 {
+		window = defaultDuplicates
+	}
+
+	s.windows[subject] = window
+
+	return window
+}
+
+// Flush waits for the server to process everything published so far. A
+// JetStream publish has already been acknowledged.
+func (s natsSink) Flush() error {
+	if s.jetStream {
+		return nil
+	}
+
+	nc, err := nats.Connection()
+	if err != nil {
+		return err
+	}
+	return nc.Flush()
+}
+
+// messageID names an envelope for JetStream de-duplication and for
+// chunking: the agent, the payload type and the envelope's sequence, which
+// together are never reused.
+func messageID(data []byte) (string, error) {
+	var e struct {
+		UUID     string `json:"magnesia_uuid"`
+		Type     string `json:"magnesia_type"`
+		Sequence uint64 `json:"magnesia_sequence"`
+	}
+
+	if err := json.Unmarshal(data, &e); err != nil {
+		return "", fmt.Errorf("invalid envelope: %v", err)
+	}
+
+	return fmt.Sprintf("%s.%s.%d", e.UUID, e.Type, e.Sequence), nil
+}
@@ -0,0 +1,337 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+)
+
+const (
+	defaultSpoolMaxSizeMB = 64
+	defaultSpoolMaxAge    = 7 * 24 * time.Hour
+	replayBatch           = 100
+)
+
+// Outbox is a directory of envelopes that could not be published. Entries
+// are named by enqueue time so a directory listing is also the replay order,
+// which keeps the spool intact across agent restarts.
+type Outbox struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	seq      uint64
+}
+
+type spoolEntry struct {
+	Subject  string          `json:"subject"`
+	QueuedAt time.Time       `json:"queued_at"`
+	Data     json.RawMessage `json:"data"`
+}
+
+type spoolFile struct {
+	name     string
+	size     int64
+	queuedAt time.Time
+}
+
+var (
+	outboxes = map[string]*Outbox{}
+	outboxMu sync.Mutex
+)
+
+// Spool returns the outbox of the named sink, sized from the "spool"
+// section of the configuration. A cap of 0 is not enforced.
+func Spool(name string) *Outbox {
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+
+	if outbox, ok := outboxes[name]; ok {
+		return outbox
+	}
+
+	outbox := &Outbox{dir: spoolDir(name)}
+
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		outbox.resize(config.Spool{MaxSizeMB: defaultSpoolMaxSizeMB, MaxAge: config.Duration{Duration: defaultSpoolMaxAge}})
+	} else {
+		outbox.resize(cfg.Spool)
+	}
+
+	outboxes[name] = outbox
+
+	return outbox
+}
+
+// resizeSpools applies the caps of a reloaded configuration. The outboxes
+// themselves are kept: each one serializes access to its directory.
+func resizeSpools(cfg config.Config) {
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+
+	for _, outbox := range outboxes {
+		outbox.resize(cfg.Spool)
+	}
+}
+
+func (o *Outbox) resize(caps config.Spool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.maxBytes = int64(caps.MaxSizeMB) * 1024 * 1024
+	o.maxAge = caps.MaxAge.Duration
+}
+
+// spoolDir keeps the NATS spool at the top of the spool directory, where
+// agents that only knew NATS left it, and gives every other sink its own
+// subdirectory.
+func spoolDir(name string) string {
+	if name == "nats" {
+		return config.SpoolDir()
+	}
+	return filepath.Join(config.SpoolDir(), name)
+}
+
+// Pending reports how many envelopes are waiting to be replayed.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	files, _ := o.files()
+
+	return len(files)
+}
+
+// Enqueue appends an envelope to the spool and then enforces the size and
+// age caps, dropping the oldest entries first. The new entry itself is
+// always kept.
+func (o *Outbox) Enqueue(subject string, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := os.MkdirAll(o.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	entry := spoolEntry{Subject: subject, QueuedAt: time.Now(), Data: data}
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spool entry: %v", err)
+	}
+
+	o.seq++
+	name := fmt.Sprintf("%019d-%06d.json", entry.QueuedAt.UnixNano(), o.seq%1000000)
+	tmp := filepath.Join(o.dir, name+".tmp")
+
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("failed to write spool entry: %v", err)
+	}
+
+	if err := os.Rename(tmp, filepath.Join(o.dir, name)); err != nil {
+		return fmt.Errorf("failed to commit spool entry: %v", err)
+	}
+
+	o.prune(name)
+
+	return nil
+}
+
+// Replay publishes spooled envelopes oldest first, removing each batch once
+// the server has acknowledged the flush. It checks online before every
+// entry and stops with ErrOffline once the connection is gone, or at the
+// first failure, leaving the remaining entries for the next attempt.
+func (o *Outbox) Replay(online func() bool, publish func(subject string, data []byte) error, flush func() error) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.prune("")
+
+	files, err := o.files()
+	if err != nil || len(files) == 0 {
+		return 0, err
+	}
+
+	sent := 0
+	batch := make([]string, 0, replayBatch)
+
+	commit := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		for _, name := range batch {
+			_ = os.Remove(filepath.Join(o.dir, name))
+		}
+		sent += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for _, f := range files {
+		if !online() {
+			_ = commit()
+			return sent, ErrOffline
+		}
+
+		content, err := os.ReadFile(filepath.Join(o.dir, f.name))
+		if err != nil {
+			return sent, err
+		}
+
+		var entry spoolEntry
+		if err := json.Unmarshal(content, &entry); err != nil {
+			console.Warn(fmt.Sprintf("Discarding corrupt spool entry %s", f.name))
+			_ = os.Remove(filepath.Join(o.dir, f.name))
+			continue
+		}
+
+		if err := publish(entry.Subject, entry.Data); err != nil {
+			_ = commit()
+			return sent, err
+		}
+
+		batch = append(batch, f.name)
+
+		if len(batch) == replayBatch {
+			if err := commit(); err != nil {
+				return sent, err
+			}
+		}
+	}
+
+	return sent, commit()
+}
+
+// Dropped is the number of entries discarded by the caps since the spool
+// was created.
+func (o *Outbox) Dropped() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.dropped()
+}
+
+// prune drops entries past the age cap, then the oldest entries until the
+// spool fits its size cap. keep, the entry just enqueued, and anything
+// queued after it are never dropped, and neither is the newest entry for
+// size alone, so an envelope larger than the cap still gets replayed.
+func (o *Outbox) prune(keep string) {
+	files, err := o.files()
+	if err != nil {
+		return
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	cutoff := time.Now().Add(-o.maxAge)
+	var expired, full []spoolFile
+
+	for i, f := range files {
+		if keep != "" && f.name >= keep {
+			break
+		}
+
+		old := o.maxAge > 0 && f.queuedAt.Before(cutoff)
+		over := o.maxBytes > 0 && total > o.maxBytes && i < len(files)-1
+		if !old && !over {
+			break
+		}
+		if err := os.Remove(filepath.Join(o.dir, f.name)); err != nil {
+			break
+		}
+		total -= f.size
+
+		if old {
+			expired = append(expired, f)
+		} else {
+			full = append(full, f)
+		}
+	}
+
+	dropped := len(expired) + len(full)
+	if dropped == 0 {
+		return
+	}
+
+	count := o.dropped() + uint64(dropped)
+	_ = os.WriteFile(filepath.Join(o.dir, "dropped"), []byte(strconv.FormatUint(count, 10)), 0600)
+
+	if len(expired) > 0 {
+		console.Warn(fmt.Sprintf("Dropped %d spooled messages older than %s, %s (%d dropped in total)", len(expired), o.maxAge, queued(expired), count))
+	}
+	if len(full) > 0 {
+		console.Warn(fmt.Sprintf("Spool %s is over %d MB, dropped the %d oldest messages, %s (%d dropped in total)", o.dir, o.maxBytes/(1024*1024), len(full), queued(full), count))
+	}
+}
+
+// queued describes when the dropped files were spooled.
+func queued(files []spoolFile) string {
+	first, last := files[0].queuedAt, files[len(files)-1].queuedAt
+	if len(files) == 1 {
+		return "queued " + first.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("queued %s to %s", first.Format(time.RFC3339), last.Format(time.RFC3339))
+}
+
+func (o *Outbox) dropped() uint64 {
+	content, err := os.ReadFile(filepath.Join(o.dir, "dropped"))
+	if err != nil {
+		return 0
+	}
+
+	count, _ := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+
+	return count
+}
+
+func (o *Outbox) files() ([]spoolFile, error) {
+	entries, err := os.ReadDir(o.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []spoolFile
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		stamp, _ := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+
+		files = append(files, spoolFile{
+			name:     name,
+			size:     info.Size(),
+			queuedAt: time.Unix(0, stamp),
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	return files, nil
+}
@@ -0,0 +1,126 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboxKeepsNewestEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		maxAge   time.Duration
+		sizes    []int
+		want     []int // indexes of the entries left, oldest first
+	}{
+		{"under the cap", 1 << 20, 0, []int{100, 100, 100}, []int{0, 1, 2}},
+		{"over the cap", 400, 0, []int{100, 100, 100}, []int{1, 2}},
+		{"entry larger than the cap", 50, 0, []int{10, 10, 100}, []int{2}},
+		{"every entry larger than the cap", 50, 0, []int{100, 100}, []int{1}},
+		{"expired", 0, time.Nanosecond, []int{10, 10, 10}, []int{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Outbox{dir: t.TempDir(), maxBytes: tt.maxBytes, maxAge: tt.maxAge}
+
+			for i, size := range tt.sizes {
+				if err := o.Enqueue("s", envelopeOf(i, size)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if left := spooled(t, o); fmt.Sprint(left) != fmt.Sprint(tt.want) {
+				t.Errorf("spool kept %v, want %v", left, tt.want)
+			}
+			if dropped := o.Dropped(); int(dropped) != len(tt.sizes)-len(tt.want) {
+				t.Errorf("Dropped = %d, want %d", dropped, len(tt.sizes)-len(tt.want))
+			}
+		})
+	}
+}
+
+func TestReplayStopsWhenOffline(t *testing.T) {
+	o := &Outbox{dir: t.TempDir()}
+
+	for i := range 5 {
+		if err := o.Enqueue("s", envelopeOf(i, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	online := true
+	var published []int
+
+	sent, err := o.Replay(func() bool { return online }, func(_ string, data []byte) error {
+		published = append(published, indexOf(data))
+		if len(published) == 2 {
+			online = false
+		}
+		return nil
+	}, func() error { return nil })
+
+	if !errors.Is(err, ErrOffline) {
+		t.Errorf("Replay = %v, want ErrOffline", err)
+	}
+	if sent != 2 || fmt.Sprint(published) != "[0 1]" {
+		t.Errorf("sent %d, published %v, want 2 and [0 1]", sent, published)
+	}
+	if o.Pending() != 3 {
+		t.Errorf("Pending = %d after the connection dropped, want 3", o.Pending())
+	}
+
+	// the rest follows in order once back online
+	online, published = true, nil
+	if sent, err := o.Replay(func() bool { return online }, func(_ string, data []byte) error {
+		published = append(published, indexOf(data))
+		return nil
+	}, func() error { return nil }); err != nil || sent != 3 {
+		t.Fatalf("second Replay sent %d, err = %v", sent, err)
+	}
+	if fmt.Sprint(published) != "[2 3 4]" {
+		t.Errorf("second Replay published %v", published)
+	}
+}
+
+// spooled lists the entries in o, oldest first, without replaying them.
+func spooled(t *testing.T, o *Outbox) []int {
+	t.Helper()
+
+	files, err := o.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var left []int
+	for _, f := range files {
+		content, err := os.ReadFile(filepath.Join(o.dir, f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry spoolEntry
+		if err := json.Unmarshal(content, &entry); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, indexOf(entry.Data))
+	}
+
+	return left
+}
+
+// envelopeOf is a JSON string of about size bytes that records i.
+func envelopeOf(i, size int) []byte {
+	return []byte(fmt.Sprintf(`"%d %s"`, i, strings.Repeat("x", size)))
+}
+
+func indexOf(data []byte) int {
+	var i int
+	fmt.Sscanf(strings.Trim(string(data), `"`), "%d", &i)
+	return i
+}
@@ -0,0 +1,443 @@
+// Package sink builds the envelopes the collectors hand it and fans them
+// out to the destinations configured for each payload type.
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auh-xda/magnesia/compression"
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/envelope"
+	"github.com/auh-xda/magnesia/identity"
+	"github.com/auh-xda/magnesia/privacy"
+	"github.com/auh-xda/magnesia/redact"
+)
+
+const defaultFullSnapshot = 6 * time.Hour
+
+// Sink is one destination for sealed envelopes.
+type Sink interface {
+	// Send delivers one envelope published on subject.
+	Send(subject string, data []byte) error
+}
+
+// Spooling is implemented by sinks whose envelopes are kept on disk while
+// they are offline and replayed once they reconnect.
+type Spooling interface {
+	Sink
+	Online() bool
+	// Publish hands data to the connection without waiting; Flush waits
+	// until the server has everything published so far.
+	Publish(subject string, data []byte) error
+	Flush() error
+}
+
+// ErrOffline is returned by Send when the destination is known to be down,
+// so retrying straight away is pointless.
+var ErrOffline = errors.New("not connected")
+
+// ErrUnacknowledged is returned by Send when the destination did not confirm
+// an envelope after the sink retried it itself, so it goes to the spool
+// without another round of retries.
+var ErrUnacknowledged = errors.New("not acknowledged")
+
+var builders = map[string]func(name string, settings config.Sink) (Sink, error){
+	"nats":      newNATS,
+	"websocket": newWebSocket,
+	"http":      newHTTP,
+	"file":      newFile,
+	"stdout":    newStdout,
+}
+
+var (
+	sinks     = map[string]Sink{}
+	sinksMu   sync.Mutex
+	delivered []func()
+
+	typeLocks   = map[string]*sync.Mutex{}
+	typeLocksMu sync.Mutex
+
+	// replayHooked names the sinks whose connection already replays their
+	// spool, so a sink rebuilt after a reload does not add a second hook
+	replayHooked = map[string]bool{}
+)
+
+// sinks are rebuilt from the new settings on their next use, and the
+// spools take the new caps
+func init() {
+	config.OnReload(func(cfg config.Config) {
+		sinksMu.Lock()
+		sinks = map[string]Sink{}
+		sinksMu.Unlock()
+
+		resizeSpools(cfg)
+	})
+}
+
+// OnDelivered registers fn to run whenever a sink took an envelope, live or
+// from its spool. Register hooks before the first SendData.
+func OnDelivered(fn func()) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+
+	delivered = append(delivered, fn)
+}
+
+func notifyDelivered() {
+	sinksMu.Lock()
+	hooks := append([]func(){}, delivered...)
+	sinksMu.Unlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// Get returns the sink listed under name in the configuration, creating it
+// on first use.
+func Get(name string) (Sink, error) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+
+	if s, ok := sinks[name]; ok {
+		return s, nil
+	}
+
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	settings, ok := cfg.Sinks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q", name)
+	}
+
+	build, ok := builders[settings.Kind(name)]
+	if !ok {
+		return nil, fmt.Errorf("sink %s has unknown type %q", name, settings.Kind(name))
+	}
+
+	s, err := build(name, settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sink %s: %v", name, err)
+	}
+
+	sinks[name] = s
+
+	return s, nil
+}
+
+// SendData turns a collector payload into a sealed envelope and sends it
+// to every sink routed for payloadType.
+func SendData(payload any, payloadType string) {
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		console.Error("Error parsing config: " + err.Error())
+		return
+	}
+
+	route := cfg.Route(payloadType)
+	if len(route) == 0 {
+		return
+	}
+
+	fullEvery := defaultFullSnapshot
+	if cfg.Delta.FullSnapshot.Duration > 0 {
+		fullEvery = cfg.Delta.FullSnapshot.Duration
+	}
+
+	profile, err := privacy.Load(cfg)
+	if err != nil {
+		console.Error("Error loading privacy profile: " + err.Error())
+		return
+	}
+
+	if payload, err = profile.Apply(payloadType, payload); err != nil {
+		console.Error("Error applying privacy profile: " + err.Error())
+		return
+	}
+
+	var redacted []string
+	if !cfg.Redact.Disabled {
+		redactor, err := redact.New(cfg.Redact.Patterns)
+		if err != nil {
+			console.Error("Error loading redaction patterns: " + err.Error())
+			return
+		}
+
+		if payload, redacted, err = redactor.Payload(payload); err != nil {
+			console.Error("Error redacting payload: " + err.Error())
+			return
+		}
+	}
+
+	// a remote command or the CLI can collect the same type while its
+	// scheduled run is publishing; both would diff against one stored
+	// state, and the second patch would not apply on top of the first
+	unlock, err := lockType(payloadType)
+	if err != nil {
+		console.Error("Error locking state: " + err.Error())
+		return
+	}
+	defer unlock()
+
+	// compare with the state of this payload type & get only changed values
+	changed, full := payload, true
+	if !cfg.Delta.Disabled {
+		changed, full, err = GetChangedValue(payloadType, payload, fullEvery)
+		if err != nil {
+			console.Error("Error getting changed values: " + err.Error())
+			return
+		}
+
+		// skip publishing if nothing changed
+		if changed == nil {
+			console.Info(fmt.Sprintf("No changes detected in %s, skipping publish", payloadType))
+			return
+		}
+	}
+
+	sequence, err := nextSequence()
+	if err != nil {
+		console.Error("Error advancing sequence: " + err.Error())
+		return
+	}
+
+	e := envelope.Envelope{
+		MagnesiaUid:       cfg.UUID,
+		MagnesiaClientId:  cfg.ClientID,
+		MagnesiaPayload:   changed,
+		MagnesiaType:      payloadType,
+		MagnesiaDelta:     !full,
+		MagnesiaRedacted:  redacted,
+		MagnesiaProfile:   profile.Name,
+		MagnesiaTimestamp: time.Now().UnixMilli(),
+		MagnesiaSequence:  sequence,
+	}
+
+	data, err := seal(e)
+	if err != nil {
+		console.Error("Error marshaling data: " + err.Error())
+		return
+	}
+
+	if !fanOut(cfg, route, cfg.Channel, data, payloadType) {
+		// a sink missed this envelope, so a delta against it would not
+		// apply there; start every sink over from a full snapshot
+		if err := os.Remove(config.State(payloadType)); err != nil && !os.IsNotExist(err) {
+			console.Error("Error resetting state: " + err.Error())
+		}
+		return
+	}
+
+	if cfg.Delta.Disabled {
+		return
+	}
+
+	state := State{Payload: payload}
+	if full {
+		state.FullAt = time.Now()
+	} else if previous, err := LoadStateData(payloadType); err == nil {
+		state.FullAt = previous.FullAt
+	}
+
+	if err := SaveStateData(payloadType, state); err != nil {
+		console.Error("Error saving state: " + err.Error())
+	}
+}
+
+// lockType serializes publishing of one payload type, from the diff to
+// saving the new state, within this process and against other agent
+// processes.
+func lockType(payloadType string) (unlock func(), err error) {
+	typeLocksMu.Lock()
+	lock, ok := typeLocks[payloadType]
+	if !ok {
+		lock = &sync.Mutex{}
+		typeLocks[payloadType] = lock
+	}
+	typeLocksMu.Unlock()
+
+	lock.Lock()
+
+	unlockFile, err := lockFile(strings.TrimSuffix(config.State(payloadType), ".json") + ".lock")
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile()
+		lock.Unlock()
+	}, nil
+}
+
+// fanOut delivers data to every sink in route at once and reports whether
+// all of them took it.
+func fanOut(cfg config.Config, route []string, subject string, data []byte, payloadType string) bool {
+	var wg sync.WaitGroup
+
+	results := make([]bool, len(route))
+
+	for i, name := range route {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = deliver(name, cfg.Sinks[name].Retry, subject, data, payloadType)
+		}()
+	}
+
+	wg.Wait()
+
+	for _, ok := range results {
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deliver sends data to one sink under its retry policy. Spooling sinks
+// fall back to their spool, or go straight to it while older envelopes are
+// waiting so publish order is kept. It reports whether the envelope was
+// handed off either way.
+func deliver(name string, policy config.Retry, subject string, data []byte, payloadType string) bool {
+	s, err := Get(name)
+	if err != nil {
+		console.Error(fmt.Sprintf("Error sending %s: %s", payloadType, err.Error()))
+		return false
+	}
+
+	spooling, canSpool := s.(Spooling)
+
+	if canSpool && Spool(name).Pending() > 0 {
+		if !spoolData(name, subject, data, payloadType) {
+			return false
+		}
+		if spooling.Online() {
+			replay(name, spooling)
+		}
+		return true
+	}
+
+	if err := retry(name, policy, func() error { return s.Send(subject, data) }); err != nil {
+		if canSpool {
+			return spoolData(name, subject, data, payloadType)
+		}
+		console.Error(fmt.Sprintf("Error sending %s to %s, message lost: %s", payloadType, name, err.Error()))
+		return false
+	}
+
+	console.Success(fmt.Sprintf("Sent %s to %s", payloadType, name))
+	notifyDelivered()
+
+	return true
+}
+
+// retry calls send up to policy.Attempts times, doubling the wait between
+// attempts. A sink that is offline, or that already retried on its own, is
+// not retried.
+func retry(name string, policy config.Retry, send func() error) error {
+	attempts := max(policy.Attempts, 1)
+	wait := policy.Backoff.Duration
+
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || errors.Is(err, ErrOffline) || errors.Is(err, ErrUnacknowledged) || attempt == attempts {
+			return err
+		}
+
+		console.Warn(fmt.Sprintf("Sending to %s failed (attempt %d of %d), retrying in %s: %s", name, attempt, attempts, wait, err.Error()))
+
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func spoolData(name, subject string, data []byte, payloadType string) bool {
+	if err := Spool(name).Enqueue(subject, data); err != nil {
+		console.Error(fmt.Sprintf("Error spooling %s, message lost: %s", payloadType, err.Error()))
+		return false
+	}
+
+	console.Warn(fmt.Sprintf("%s is not reachable, %s spooled for later delivery", name, payloadType))
+
+	return true
+}
+
+// replayOnConnect has connect replay the spool of name whenever its
+// connection comes up. Get calls builders with sinksMu held. A sink not
+// rebuilt since a reload replays from deliver on its next envelope.
+func replayOnConnect(name string, connect func(replay func())) {
+	if replayHooked[name] {
+		return
+	}
+	replayHooked[name] = true
+
+	connect(func() {
+		sinksMu.Lock()
+		s := sinks[name]
+		sinksMu.Unlock()
+
+		if spooling, ok := s.(Spooling); ok {
+			replay(name, spooling)
+		}
+	})
+}
+
+// replay delivers envelopes spooled for name while it was offline.
+func replay(name string, s Spooling) {
+	sent, err := Spool(name).Replay(s.Online, s.Publish, s.Flush)
+
+	if sent > 0 {
+		console.Success(fmt.Sprintf("Replayed %d spooled messages to %s", sent, name))
+		notifyDelivered()
+	}
+
+	if err != nil {
+		console.Warn("Spool replay interrupted: " + err.Error())
+	}
+}
+
+// compress encodes data for a network sink and logs what it saved.
+func compress(name string, settings config.Compression, data []byte) ([]byte, string, error) {
+	encoded, algorithm, err := compression.Encode(data, settings.Algorithm, settings.MinSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if algorithm != compression.None {
+		console.Info(fmt.Sprintf("Compressed envelope for %s with %s from %d to %d bytes (%.1fx)", name, algorithm, len(data), len(encoded), float64(len(data))/float64(len(encoded))))
+	}
+
+	return encoded, algorithm, nil
+}
+
+// seal signs the envelope with the agent key. Agents enrolled before keys
+// existed have none and publish unsigned envelopes.
+func seal(e envelope.Envelope) ([]byte, error) {
+	kp, err := identity.Load()
+	if os.IsNotExist(err) {
+		return json.Marshal(e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer kp.Wipe()
+
+	public, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope.Sign(e, public, kp.Sign)
+}
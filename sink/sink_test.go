@@ -0,0 +1,412 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/envelope"
+)
+
+func TestRetry(t *testing.T) {
+	failure := errors.New("refused")
+
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		want     int
+	}{
+		{"success", nil, 3, 1},
+		{"failure", failure, 3, 3},
+		{"no attempts configured", failure, 0, 1},
+		{"offline", ErrOffline, 3, 1},
+		{"unacknowledged", fmt.Errorf("%w by JetStream", ErrUnacknowledged), 3, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retry("test", config.Retry{Attempts: tt.attempts}, func() error {
+				calls++
+				return tt.err
+			})
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("retry = %v, want %v", err, tt.err)
+			}
+			if calls != tt.want {
+				t.Errorf("send called %d times, want %d", calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadRebuildsSinksAndResizesSpools(t *testing.T) {
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	cfg := config.Defaults()
+	cfg.UUID = "a"
+	cfg.Spool.MaxSizeMB = 1
+	if err := config.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Get("stdout"); err != nil {
+		t.Fatal(err)
+	}
+	outbox := Spool("reload-test")
+	t.Cleanup(func() {
+		outboxMu.Lock()
+		delete(outboxes, "reload-test")
+		outboxMu.Unlock()
+	})
+
+	cfg.Spool.MaxSizeMB = 2
+	if err := config.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	sinksMu.Lock()
+	_, cached := sinks["stdout"]
+	sinksMu.Unlock()
+	if cached {
+		t.Error("sink built before the reload is still cached")
+	}
+	if after, err := Get("stdout"); err != nil || after == nil {
+		t.Errorf("Get after reload = %v, %v", after, err)
+	}
+
+	if Spool("reload-test") != outbox {
+		t.Error("reload replaced the outbox")
+	}
+	if outbox.maxBytes != 2<<20 {
+		t.Errorf("spool cap = %d after reload, want %d", outbox.maxBytes, 2<<20)
+	}
+}
+
+// fakeSink records what it is sent, or fails with err.
+type fakeSink struct {
+	mu    sync.Mutex
+	err   error
+	calls int
+	sent  [][]byte
+}
+
+func (f *fakeSink) Send(_ string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, data)
+
+	return nil
+}
+
+func (f *fakeSink) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
+
+func (f *fakeSink) envelopes(t *testing.T) []envelope.Envelope {
+	t.Helper()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var envelopes []envelope.Envelope
+	for _, data := range f.sent {
+		var e envelope.Envelope
+		if err := json.Unmarshal(data, &e); err != nil {
+			t.Fatal(err)
+		}
+		envelopes = append(envelopes, e)
+	}
+
+	return envelopes
+}
+
+// fakeSpooling is a fakeSink with a connection that is up or down, so
+// envelopes go to its spool while it is down.
+type fakeSpooling struct {
+	fakeSink
+	down bool
+}
+
+func (f *fakeSpooling) Send(subject string, data []byte) error {
+	if !f.Online() {
+		return ErrOffline
+	}
+	return f.fakeSink.Send(subject, data)
+}
+
+func (f *fakeSpooling) Online() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return !f.down
+}
+
+func (f *fakeSpooling) Publish(subject string, data []byte) error {
+	return f.Send(subject, data)
+}
+
+func (f *fakeSpooling) Flush() error {
+	return nil
+}
+
+// useFakes saves a configuration with routes and a sink for each of the
+// given names, and puts the fakes in place of the sinks Get would build.
+func useFakes(t *testing.T, routes map[string][]string, fakes map[string]Sink) {
+	t.Helper()
+
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	cfg := config.Defaults()
+	cfg.UUID = "a"
+	cfg.Routes = routes
+	for name := range fakes {
+		cfg.Sinks[name] = config.Sink{Type: "stdout"}
+	}
+	if err := config.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	sinksMu.Lock()
+	for name, fake := range fakes {
+		sinks[name] = fake
+	}
+	sinksMu.Unlock()
+
+	t.Cleanup(func() {
+		sinksMu.Lock()
+		sinks = map[string]Sink{}
+		sinksMu.Unlock()
+
+		outboxMu.Lock()
+		for name := range fakes {
+			delete(outboxes, name)
+		}
+		outboxMu.Unlock()
+	})
+}
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes map[string][]string
+		want   map[string]int // envelopes each sink receives
+	}{
+		{"transport by default", nil, map[string]int{"nats": 1, "a": 0, "b": 0}},
+		{"own route", map[string][]string{"power": {"a"}, "*": {"b"}}, map[string]int{"nats": 0, "a": 1, "b": 0}},
+		{"wildcard", map[string][]string{"services": {"a"}, "*": {"b"}}, map[string]int{"nats": 0, "a": 0, "b": 1}},
+		{"several sinks", map[string][]string{"power": {"nats", "a", "b"}}, map[string]int{"nats": 1, "a": 1, "b": 1}},
+		{"routed nowhere", map[string][]string{"power": {}}, map[string]int{"nats": 0, "a": 0, "b": 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := map[string]*fakeSink{"nats": {}, "a": {}, "b": {}}
+			useFakes(t, tt.routes, map[string]Sink{"nats": fakes["nats"], "a": fakes["a"], "b": fakes["b"]})
+
+			SendData(map[string]any{"level": 1}, "power")
+
+			for name, want := range tt.want {
+				if got := len(fakes[name].sent); got != want {
+					t.Errorf("%s received %d envelopes, want %d", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	refused := errors.New("refused")
+	policy := config.Retry{Attempts: 2}
+
+	t.Run("sent", func(t *testing.T) {
+		fake := &fakeSink{}
+		useFakes(t, nil, map[string]Sink{"a": fake})
+
+		if !deliver("a", policy, "s", []byte("1"), "power") || len(fake.sent) != 1 {
+			t.Errorf("envelope not delivered: %d sent", len(fake.sent))
+		}
+	})
+
+	t.Run("lost after retries", func(t *testing.T) {
+		fake := &fakeSink{err: refused}
+		useFakes(t, nil, map[string]Sink{"a": fake})
+
+		if deliver("a", policy, "s", []byte("1"), "power") {
+			t.Error("deliver reported a refused envelope as handed off")
+		}
+		if fake.calls != 2 {
+			t.Errorf("send called %d times, want 2", fake.calls)
+		}
+	})
+
+	t.Run("unknown sink", func(t *testing.T) {
+		useFakes(t, nil, nil)
+
+		if deliver("nope", policy, "s", []byte("1"), "power") {
+			t.Error("deliver reported success for a sink that does not exist")
+		}
+	})
+
+	t.Run("spooled while offline, replayed in order", func(t *testing.T) {
+		fake := &fakeSpooling{down: true}
+		useFakes(t, nil, map[string]Sink{"a": fake})
+
+		if !deliver("a", policy, "s", []byte("1"), "power") {
+			t.Fatal("offline envelope was not spooled")
+		}
+		if len(fake.sent) != 0 || Spool("a").Pending() != 1 {
+			t.Fatalf("%d sent, %d pending, want it spooled", len(fake.sent), Spool("a").Pending())
+		}
+
+		// older envelopes are waiting, so the next one queues behind them
+		// and both go out once the sink is back
+		fake.mu.Lock()
+		fake.down = false
+		fake.mu.Unlock()
+
+		if !deliver("a", policy, "s", []byte("2"), "power") {
+			t.Fatal("envelope behind the spool was not handed off")
+		}
+		if Spool("a").Pending() != 0 {
+			t.Errorf("%d envelopes left in the spool", Spool("a").Pending())
+		}
+		if got := fmt.Sprintf("%s", fake.sent); got != "[1 2]" {
+			t.Errorf("sink received %s, want [1 2]", got)
+		}
+	})
+}
+
+func TestFanOut(t *testing.T) {
+	a, b := &fakeSink{}, &fakeSink{err: errors.New("refused")}
+	useFakes(t, nil, map[string]Sink{"a": a, "b": b})
+
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fanOut(cfg, []string{"a"}, "s", []byte("1"), "power") {
+		t.Error("fanOut to a working sink failed")
+	}
+	if fanOut(cfg, []string{"a", "b"}, "s", []byte("2"), "power") {
+		t.Error("fanOut reported success with a failing sink")
+	}
+	if len(a.sent) != 2 {
+		t.Errorf("a received %d envelopes, want 2 in spite of b failing", len(a.sent))
+	}
+}
+
+func TestPartialFailureResetsState(t *testing.T) {
+	a, b := &fakeSink{}, &fakeSink{}
+	useFakes(t, map[string][]string{"*": {"a", "b"}}, map[string]Sink{"a": a, "b": b})
+
+	SendData(map[string]any{"level": 1}, "power")
+	if _, err := LoadStateData("power"); err != nil {
+		t.Fatalf("no state after a delivered snapshot: %v", err)
+	}
+
+	// b misses a delta, so neither sink may get the next one against it
+	b.fail(errors.New("refused"))
+	SendData(map[string]any{"level": 2}, "power")
+	if _, err := os.Stat(config.State("power")); !os.IsNotExist(err) {
+		t.Fatalf("state kept after b missed an envelope: %v", err)
+	}
+
+	b.fail(nil)
+	SendData(map[string]any{"level": 2}, "power")
+
+	for name, fake := range map[string]*fakeSink{"a": a, "b": b} {
+		envelopes := fake.envelopes(t)
+		last := envelopes[len(envelopes)-1]
+		if last.MagnesiaDelta {
+			t.Errorf("%s got a delta after the failure, want a full snapshot", name)
+		}
+	}
+	if _, err := LoadStateData("power"); err != nil {
+		t.Errorf("no state after the full snapshot: %v", err)
+	}
+}
+
+func TestSendDataConcurrently(t *testing.T) {
+	fake := &fakeSink{}
+	useFakes(t, map[string][]string{"power": {"fake"}}, map[string]Sink{"fake": fake})
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			SendData(map[string]any{"run": i, "battery": map[string]any{"level": i % 3}}, "power")
+		}()
+	}
+	wg.Wait()
+
+	// every run sends a level of run % 3
+	consistent := func(doc any) bool {
+		m, _ := doc.(map[string]any)
+		run, _ := m["run"].(float64)
+		battery, _ := m["battery"].(map[string]any)
+		level, ok := battery["level"].(float64)
+		return ok && len(m) == 2 && int(level) == int(run)%3
+	}
+
+	// the server applies each delta on top of the envelope before it
+	doc := any(nil)
+	last := uint64(0)
+	for _, e := range fake.envelopes(t) {
+		if e.MagnesiaSequence <= last {
+			t.Fatalf("sequence %d arrived after %d", e.MagnesiaSequence, last)
+		}
+		last = e.MagnesiaSequence
+
+		if !e.MagnesiaDelta {
+			doc = e.MagnesiaPayload
+			continue
+		}
+
+		data, _ := json.Marshal(e.MagnesiaPayload)
+		var ops []map[string]any
+		if err := json.Unmarshal(data, &ops); err != nil {
+			t.Fatal(err)
+		}
+
+		var err error
+		if doc, err = applyPatch(doc, ops); err != nil {
+			t.Fatalf("sequence %d does not apply: %v", e.MagnesiaSequence, err)
+		}
+		if !consistent(doc) {
+			t.Fatalf("sequence %d left %v, which no run sent", e.MagnesiaSequence, doc)
+		}
+	}
+
+	state, err := LoadStateData("power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := normalize(state.Payload)
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("server has %v, agent state is %v", doc, want)
+	}
+}
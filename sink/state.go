@@ -0,0 +1,140 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auh-xda/magnesia/config"
+)
+
+// ---------------- State Handling ----------------
+
+var sequenceMu sync.Mutex
+
+// nextSequence returns the next envelope sequence number. It is persisted
+// before use so a number is never handed out twice, even across restarts
+// or by the CLI publishing while the service runs.
+func nextSequence() (uint64, error) {
+	sequenceMu.Lock()
+	defer sequenceMu.Unlock()
+
+	path := config.Sequence()
+
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	// a number the server has seen must never come back, so a sequence
+	// file that cannot be read stops publishing instead of starting over
+	var last uint64
+	content, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if last, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid sequence in %s, restore it from the server's last sequence: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		return 0, fmt.Errorf("failed to read sequence: %v", err)
+	}
+
+	next := last + 1
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(next, 10)), 0644); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+
+	return next, nil
+}
+
+// ResetState forgets the last published payload of every type, so each one
+// is sent as a full snapshot next time.
+func ResetState() error {
+	paths, err := filepath.Glob(config.State("*"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to reset state: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// State is the last payload published for one payload type, together with
+// the time of the last full snapshot.
+type State struct {
+	FullAt  time.Time `json:"full_at"`
+	Payload any       `json:"payload"`
+}
+
+// GetChangedValue compares payload with the stored state of its type. It
+// returns the whole payload with full set when there is no usable state or
+// the last full snapshot is older than fullEvery, otherwise a JSON Patch of
+// the changes, which is nil when nothing changed.
+func GetChangedValue(payloadType string, payload any, fullEvery time.Duration) (any, bool, error) {
+	state, err := LoadStateData(payloadType)
+	if err != nil || state.Payload == nil || time.Since(state.FullAt) >= fullEvery {
+		return payload, true, nil
+	}
+
+	changed, err := DeepDiff(payloadType, state.Payload, payload)
+	if err != nil || len(changed) == 0 {
+		return nil, false, err
+	}
+
+	return changed, false, nil
+}
+
+func LoadStateData(payloadType string) (State, error) {
+	var state State
+
+	content, err := os.ReadFile(config.State(payloadType))
+	if err != nil {
+		// no file yet
+		return state, err
+	}
+
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, fmt.Errorf("invalid JSON in state file: %w", err)
+	}
+	return state, nil
+}
+
+func SaveStateData(payloadType string, state State) error {
+	path := config.State(payloadType)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	return nil
+}
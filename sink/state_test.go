@@ -0,0 +1,129 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/auh-xda/magnesia/config"
+)
+
+func TestNextSequence(t *testing.T) {
+	tests := []struct {
+		name    string
+		content *string
+		want    uint64
+		wantErr bool
+	}{
+		{"first envelope", nil, 1, false},
+		{"continues", ptr("41"), 42, false},
+		{"trailing newline", ptr("41\n"), 42, false},
+		{"corrupt", ptr("4x"), 0, true},
+		{"empty", ptr(""), 0, true},
+		{"negative", ptr("-1"), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+			if tt.content != nil {
+				if err := os.MkdirAll(filepath.Dir(config.Sequence()), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(config.Sequence(), []byte(*tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := nextSequence()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("nextSequence = %d, want an error", got)
+				}
+				if content, _ := os.ReadFile(config.Sequence()); string(content) != *tt.content {
+					t.Errorf("sequence file rewritten to %q", content)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("nextSequence = %d, want %d", got, tt.want)
+			}
+			if again, _ := nextSequence(); again != tt.want+1 {
+				t.Errorf("second nextSequence = %d, want %d", again, tt.want+1)
+			}
+		})
+	}
+}
+
+// TestNextSequenceAcrossProcesses runs agents in child processes that share
+// one state directory, as the service and the CLI do.
+func TestNextSequenceAcrossProcesses(t *testing.T) {
+	const processes, each = 4, 200
+
+	if os.Getenv("SEQUENCE_CHILD") != "" {
+		for range each {
+			n, err := nextSequence()
+			if err != nil {
+				fmt.Println("error:", err)
+				os.Exit(1)
+			}
+			fmt.Println(n)
+		}
+		os.Exit(0)
+	}
+
+	t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+	outputs := make([][]byte, processes)
+	errs := make(chan error, processes)
+
+	for i := range processes {
+		go func() {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestNextSequenceAcrossProcesses$")
+			cmd.Env = append(os.Environ(), "SEQUENCE_CHILD=1")
+
+			var err error
+			outputs[i], err = cmd.Output()
+			errs <- err
+		}()
+	}
+	for range processes {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[uint64]bool{}
+	for _, output := range outputs {
+		for _, line := range strings.Fields(string(output)) {
+			n, err := strconv.ParseUint(line, 10, 64)
+			if err != nil {
+				continue
+			}
+			if seen[n] {
+				t.Errorf("sequence %d handed out twice", n)
+			}
+			seen[n] = true
+		}
+	}
+
+	if len(seen) != processes*each {
+		t.Errorf("got %d sequence numbers, want %d", len(seen), processes*each)
+	}
+	if last, _ := nextSequence(); last != processes*each+1 {
+		t.Errorf("next sequence = %d, want %d", last, processes*each+1)
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
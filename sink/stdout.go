@@ -0,0 +1,27 @@
+package sink
+
+import (
+	"os"
+	"sync"
+
+	"github.com/auh-xda/magnesia/config"
+)
+
+// stdoutSink writes each envelope as a line on standard output, between
+// the agent's own log lines. It suits containers and debugging.
+type stdoutSink struct{}
+
+var stdoutMu sync.Mutex
+
+func newStdout(_ string, _ config.Sink) (Sink, error) {
+	return stdoutSink{}, nil
+}
+
+func (stdoutSink) Send(_ string, data []byte) error {
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+
+	_, err := os.Stdout.Write(append(data[:len(data):len(data)], '\n'))
+
+	return err
+}
@@ -0,0 +1,59 @@
+package sink
+
+import (
+	"github.com/auh-xda/magnesia/compression"
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/ws"
+)
+
+// wsSink publishes on the agent's WebSocket to Momentum.
+type wsSink struct {
+	name        string
+	compression config.Compression
+}
+
+func newWebSocket(name string, settings config.Sink) (Sink, error) {
+	s := wsSink{name: name, compression: settings.Compression}
+
+	replayOnConnect(name, func(replay func()) {
+		ws.OnConnect(func(*ws.Conn) { replay() })
+	})
+
+	return s, nil
+}
+
+func (wsSink) Online() bool {
+	c, err := ws.Connection()
+
+	return err == nil && c.IsConnected()
+}
+
+func (s wsSink) Send(subject string, data []byte) error {
+	return s.Publish(subject, data)
+}
+
+func (s wsSink) Publish(subject string, data []byte) error {
+	c, err := ws.Connection()
+	if err != nil {
+		return err
+	}
+	if !c.IsConnected() {
+		return ErrOffline
+	}
+
+	encoded, algorithm, err := compress(s.name, s.compression, data)
+	if err != nil {
+		return err
+	}
+
+	if algorithm == compression.None {
+		return c.Publish(subject, data)
+	}
+
+	return c.PublishFrame(ws.Frame{Subject: subject, Encoding: algorithm, Compressed: encoded})
+}
+
+// Flush has nothing to wait for, a frame is written when Publish returns.
+func (wsSink) Flush() error {
+	return nil
+}
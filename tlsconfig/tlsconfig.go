@@ -0,0 +1,88 @@
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/auh-xda/magnesia/config"
+)
+
+// New builds the TLS client configuration shared by the Momentum and NATS
+// connections.
+func New(settings config.TLS) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if settings.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(settings.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls.ca: %v", err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls.ca %s contains no PEM certificates", settings.CA)
+		}
+
+		conf.RootCAs = pool
+	}
+
+	if settings.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(settings.Cert, settings.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(settings.Pins) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range settings.Pins {
+			pins[strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")] = true
+		}
+
+		conf.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				if pins[Pin(cert)] {
+					return nil
+				}
+			}
+			return fmt.Errorf("certificate of %s does not match any pin in tls.pins", state.ServerName)
+		}
+	}
+
+	return conf, nil
+}
+
+// Pin is the base64 SHA-256 of a certificate's SubjectPublicKeyInfo, the
+// value listed in tls.pins.
+func Pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Plaintext reports whether rawURL would be sent unencrypted.
+func Plaintext(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return true
+	}
+
+	switch u.Scheme {
+	case "https", "wss", "tls":
+		return false
+	default:
+		return true
+	}
+}
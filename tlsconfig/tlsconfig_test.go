@@ -0,0 +1,139 @@
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/auh-xda/magnesia/config"
+)
+
+func TestPins(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// trust the test server's self-signed certificate through tls.ca
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	cert := server.Certificate()
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("another key"))
+	otherPin := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr string
+	}{
+		{"no pins", nil, ""},
+		{"pinned", []string{Pin(cert)}, ""},
+		{"pinned with prefix", []string{"sha256/" + Pin(cert)}, ""},
+		{"one of several pins", []string{otherPin, Pin(cert)}, ""},
+		{"not pinned", []string{otherPin}, "does not match any pin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := New(config.TLS{CA: ca, Pins: tt.pins})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+			response, err := client.Get(server.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("request failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("request = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUntrustedCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// a pin does not replace certificate validation
+	conf, err := New(config.TLS{Pins: []string{Pin(server.Certificate())}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	if response, err := client.Get(server.URL); err == nil {
+		response.Body.Close()
+		t.Error("connected to a server whose certificate is not trusted")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		settings config.TLS
+		wantErr  string
+	}{
+		{"missing ca", config.TLS{CA: filepath.Join(dir, "missing.pem")}, "failed to read tls.ca"},
+		{"ca without certificates", config.TLS{CA: notPEM}, "contains no PEM certificates"},
+		{"missing client certificate", config.TLS{Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "key.pem")}, "failed to load client certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.settings); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("New = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestPlaintext covers the check tls.strict applies before every request
+// and connection.
+func TestPlaintext(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	encrypted := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer encrypted.Close()
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{plain.URL, true},
+		{encrypted.URL, false},
+		{"wss://momentum.example.com/ws", false},
+		{"tls://nats.example.com:4222", false},
+		{"ws://momentum.example.com/ws", true},
+		{"nats://nats.example.com:4222", true},
+		{"momentum.example.com", true},
+		{"://bad", true},
+	}
+
+	for _, tt := range tests {
+		if got := Plaintext(tt.url); got != tt.want {
+			t.Errorf("Plaintext(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
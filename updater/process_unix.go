@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package updater
+
+import (
+	"errors"
+	"syscall"
+)
+
+// running reports whether a process with pid exists.
+func running(pid int) bool {
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
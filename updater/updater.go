@@ -0,0 +1,446 @@
+package updater
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auh-xda/magnesia/client"
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/installer"
+)
+
+const (
+	releaseEndpoint = "/api/agent/release"
+	defaultGrace    = 2 * time.Minute
+	healthPoll      = 2 * time.Second
+
+	// lockSlack is how long an update may take besides the grace period
+	// before its lock counts as left behind by a crashed updater
+	lockSlack = 15 * time.Minute
+)
+
+// Release describes the binary Momentum offers for this platform. SHA256 is
+// hex encoded; Signature is a base64 Ed25519 signature of the release
+// manifest made with the key whose public half is configured as update.key.
+type Release struct {
+	Version   string `json:"version"`
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// Health is written by a freshly started agent so the updater can tell the
+// new binary came up.
+type Health struct {
+	Version   string    `json:"version"`
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Update replaces the installed binary with the latest release, restarts
+// the service and rolls back if the new version does not report healthy
+// within the grace period.
+func Update(cfg config.Config, current string, force bool) error {
+	grace := defaultGrace
+	if cfg.Update.Grace.Duration > 0 {
+		grace = cfg.Update.Grace.Duration
+	}
+
+	unlock, err := lock(grace + lockSlack)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	release, err := latest(cfg)
+	if err != nil {
+		return err
+	}
+
+	install, err := offered(release, current, force)
+	if err != nil {
+		return err
+	}
+	if !install {
+		console.Success(fmt.Sprintf("Magnesia %s is already up to date", current))
+		return nil
+	}
+
+	console.Info(fmt.Sprintf("Updating Magnesia %s to %s", current, release.Version))
+
+	binary, err := download(release)
+	if err != nil {
+		return err
+	}
+
+	if err := verify(cfg.Update.Key, release, binary); err != nil {
+		return err
+	}
+
+	console.Success("Release checksum and signature verified")
+
+	target := installer.BinaryPath()
+	if err := swap(target, binary); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(pendingPath(), []byte(release.Version), 0644); err != nil {
+		return rollback(target, fmt.Errorf("failed to mark update as pending: %v", err))
+	}
+	defer os.Remove(pendingPath())
+
+	restartedAt := time.Now()
+
+	if err := installer.Restart(); err != nil {
+		console.Error(err.Error())
+		return rollback(target, fmt.Errorf("new version failed to start: %v", err))
+	}
+
+	console.Info(fmt.Sprintf("Waiting up to %s for %s to report healthy", grace, release.Version))
+
+	if !waitHealthy(release.Version, restartedAt, grace) {
+		return rollback(target, fmt.Errorf("version %s did not report healthy within %s", release.Version, grace))
+	}
+
+	console.Success(fmt.Sprintf("Magnesia updated to %s", release.Version))
+
+	return nil
+}
+
+// Verifying reports whether an update to version is waiting for this binary
+// to report healthy.
+func Verifying(version string) bool {
+	pending, err := os.ReadFile(pendingPath())
+
+	return err == nil && strings.TrimSpace(string(pending)) == version
+}
+
+// ReportHealthy records that this binary works. The agent calls it once it
+// delivered its first envelope.
+func ReportHealthy(version string) {
+	health := Health{Version: version, PID: os.Getpid(), StartedAt: time.Now()}
+
+	data, err := json.Marshal(health)
+	if err != nil {
+		return
+	}
+
+	if err := os.WriteFile(healthPath(), data, 0644); err != nil {
+		console.Error("Error writing health file: " + err.Error())
+	}
+}
+
+func latest(cfg config.Config) (Release, error) {
+	var release Release
+
+	query := url.Values{}
+	query.Set("os", runtime.GOOS)
+	query.Set("arch", runtime.GOARCH)
+	query.Set("uuid", cfg.UUID)
+
+	response, err := client.Get(releaseEndpoint + "?" + query.Encode())
+	if err != nil {
+		return release, fmt.Errorf("failed to query latest release: %v", err)
+	}
+
+	if !response.IsSuccess() {
+		return release, fmt.Errorf("failed to query latest release: %s", response.Status())
+	}
+
+	if err := json.Unmarshal(response.Body(), &release); err != nil {
+		return release, fmt.Errorf("error unmarshaling release: %v", err)
+	}
+
+	if release.Version == "" || release.URL == "" {
+		return release, fmt.Errorf("server returned an incomplete release")
+	}
+
+	return release, nil
+}
+
+func download(release Release) ([]byte, error) {
+	console.Info("Downloading " + release.URL)
+
+	response, err := client.Get(release.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download release: %v", err)
+	}
+
+	if !response.IsSuccess() {
+		return nil, fmt.Errorf("failed to download release: %s", response.Status())
+	}
+
+	return response.Body(), nil
+}
+
+// offered reports whether release should replace current. A release older
+// than current is refused unless force is set, so a replayed or compromised
+// release listing cannot roll agents back to a vulnerable version.
+func offered(release Release, current string, force bool) (bool, error) {
+	if force {
+		return true, nil
+	}
+
+	order, err := compareVersions(release.Version, current)
+	if err != nil {
+		return false, fmt.Errorf("%v, use -force to install %s anyway", err, release.Version)
+	}
+
+	if order < 0 {
+		return false, fmt.Errorf("refusing to downgrade from %s to %s without -force", current, release.Version)
+	}
+
+	return order > 0, nil
+}
+
+// compareVersions orders two versions such as "1.2.3", "v1.2.3" or
+// "1.3.0-rc.1"; a pre-release comes before its release.
+func compareVersions(a, b string) (int, error) {
+	pa, preA, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	pb, preB, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range 3 {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	switch {
+	case preA == preB:
+		return 0, nil
+	case preA == "":
+		return 1, nil
+	case preB == "":
+		return -1, nil
+	case preA < preB:
+		return -1, nil
+	default:
+		return 1, nil
+	}
+}
+
+func parseVersion(version string) ([3]int, string, error) {
+	var parts [3]int
+
+	core, pre, _ := strings.Cut(strings.TrimPrefix(version, "v"), "-")
+
+	fields := strings.Split(core, ".")
+	if len(fields) != 3 {
+		return parts, "", fmt.Errorf("cannot compare version %q", version)
+	}
+
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return parts, "", fmt.Errorf("cannot compare version %q", version)
+		}
+		parts[i] = n
+	}
+
+	return parts, pre, nil
+}
+
+// manifest is what a release signature covers, so a signed binary cannot
+// be offered as another version or for another platform.
+func manifest(release Release) []byte {
+	return []byte(fmt.Sprintf("version=%s\nos=%s\narch=%s\nsha256=%s\n",
+		release.Version, runtime.GOOS, runtime.GOARCH, strings.ToLower(release.SHA256)))
+}
+
+func verify(publicKey string, release Release, binary []byte) error {
+	sum := sha256.Sum256(binary)
+
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), release.SHA256) {
+		return fmt.Errorf("checksum mismatch, refusing to install")
+	}
+
+	if publicKey == "" {
+		return fmt.Errorf("no update.key configured, refusing to install an unverifiable binary")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("update.key is not a base64 Ed25519 public key")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(release.Signature)
+	if err != nil {
+		return fmt.Errorf("malformed release signature: %v", err)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(key), manifest(release), sig) {
+		return fmt.Errorf("signature verification failed, refusing to install")
+	}
+
+	return nil
+}
+
+// swap moves the running binary aside to target.old and renames the new
+// one into place, so target always holds a complete binary.
+func swap(target string, binary []byte) error {
+	staged := target + ".new"
+
+	f, err := os.OpenFile(staged, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to stage binary: %v", err)
+	}
+
+	if _, err := f.Write(binary); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stage binary: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stage binary: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to stage binary: %v", err)
+	}
+
+	_ = os.Remove(target + ".old")
+
+	if err := os.Rename(target, target+".old"); err != nil {
+		return fmt.Errorf("failed to back up current binary: %v", err)
+	}
+
+	if err := os.Rename(staged, target); err != nil {
+		_ = os.Rename(target+".old", target)
+		return fmt.Errorf("failed to install new binary: %v", err)
+	}
+
+	return nil
+}
+
+// rollback stops the service before restoring the previous binary, since
+// Windows does not let a running binary be replaced.
+func rollback(target string, cause error) error {
+	console.Warn("Rolling back to the previous binary")
+
+	if err := installer.Stop(); err != nil {
+		console.Warn(err.Error())
+	}
+
+	if err := os.Rename(target+".old", target); err != nil {
+		return fmt.Errorf("%v; rollback failed: %v", cause, err)
+	}
+
+	if err := installer.Start(); err != nil {
+		return fmt.Errorf("%v; rolled back but start failed: %v", cause, err)
+	}
+
+	return fmt.Errorf("%v; rolled back", cause)
+}
+
+func waitHealthy(version string, since time.Time, grace time.Duration) bool {
+	deadline := time.Now().Add(grace)
+
+	for time.Now().Before(deadline) {
+		var health Health
+
+		if data, err := os.ReadFile(healthPath()); err == nil && json.Unmarshal(data, &health) == nil {
+			if health.Version == version && health.StartedAt.After(since) {
+				return true
+			}
+		}
+
+		time.Sleep(healthPoll)
+	}
+
+	return false
+}
+
+// lock keeps a remote and a manual update from racing each other. The lock
+// file holds the updater's PID; a lock whose process is gone, or that is
+// older than staleAfter, was left by a crashed updater and is taken over.
+func lock(staleAfter time.Duration) (func(), error) {
+	path := lockPath()
+
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("failed to take update lock: %v", err)
+			}
+			return func() { _ = os.Remove(path) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to take update lock: %v", err)
+		}
+
+		if attempt > 0 || !stale(path, staleAfter) {
+			return nil, fmt.Errorf("another update is in progress (%s)", path)
+		}
+
+		console.Warn("Removing stale update lock " + path)
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale update lock: %v", err)
+		}
+	}
+}
+
+func stale(path string, staleAfter time.Duration) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+
+	if time.Since(info.ModTime()) > staleAfter {
+		return true
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		// written by an updater that did not record its PID, or cut short
+		// while writing it
+		return time.Since(info.ModTime()) > time.Minute
+	}
+
+	return !running(pid)
+}
+
+func lockPath() string {
+	return filepath.Join(config.Dir(), "update.lock")
+}
+
+func pendingPath() string {
+	return filepath.Join(config.Dir(), "update.pending")
+}
+
+func healthPath() string {
+	return filepath.Join(config.Dir(), "health.json")
+}
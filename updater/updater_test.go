@@ -0,0 +1,177 @@
+package updater
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("starts a POSIX command")
+	}
+
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead := strconv.Itoa(exited.Process.Pid)
+	live := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		name    string
+		content *string
+		age     time.Duration
+		taken   bool
+	}{
+		{"no lock", nil, 0, true},
+		{"held by a running process", &live, 0, false},
+		{"held by an exited process", &dead, 0, true},
+		{"older than the timeout", &live, 2 * time.Hour, true},
+		{"no pid, recent", ptr(""), 0, false},
+		{"no pid, old", ptr(""), 2 * time.Minute, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAGNESIA_DIR", t.TempDir())
+
+			if tt.content != nil {
+				if err := os.WriteFile(lockPath(), []byte(*tt.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+				modified := time.Now().Add(-tt.age)
+				if err := os.Chtimes(lockPath(), modified, modified); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			unlock, err := lock(time.Hour)
+			if !tt.taken {
+				if err == nil {
+					t.Fatal("took a lock held by a live updater")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content, _ := os.ReadFile(lockPath()); string(content) != live {
+				t.Errorf("lock holds %q, want our pid %s", content, live)
+			}
+
+			if _, err := lock(time.Hour); err == nil {
+				t.Error("took the lock twice")
+			}
+
+			unlock()
+			if _, err := os.Stat(lockPath()); !os.IsNotExist(err) {
+				t.Error("unlock left the lock file behind")
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := base64.StdEncoding.EncodeToString(public)
+
+	binary := []byte("new magnesia")
+	sum := sha256.Sum256(binary)
+
+	sign := func(message string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(message)))
+	}
+	signed := func(version, goos, goarch string) string {
+		return sign(fmt.Sprintf("version=%s\nos=%s\narch=%s\nsha256=%s\n", version, goos, goarch, hex.EncodeToString(sum[:])))
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		signature string
+		sha256    string
+		wantErr   string
+	}{
+		{"signed manifest", key, signed("1.1.0", runtime.GOOS, runtime.GOARCH), "", ""},
+		{"uppercase checksum", key, signed("1.1.0", runtime.GOOS, runtime.GOARCH), strings.ToUpper(hex.EncodeToString(sum[:])), ""},
+		{"binary signed alone", key, sign(string(binary)), "", "signature verification failed"},
+		{"signed for another version", key, signed("0.9.0", runtime.GOOS, runtime.GOARCH), "", "signature verification failed"},
+		{"signed for another platform", key, signed("1.1.0", "plan9", runtime.GOARCH), "", "signature verification failed"},
+		{"checksum mismatch", key, signed("1.1.0", runtime.GOOS, runtime.GOARCH), strings.Repeat("0", 64), "checksum mismatch"},
+		{"no key", "", signed("1.1.0", runtime.GOOS, runtime.GOARCH), "", "no update.key"},
+		{"malformed key", "abc", signed("1.1.0", runtime.GOOS, runtime.GOARCH), "", "not a base64 Ed25519"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := Release{Version: "1.1.0", SHA256: hex.EncodeToString(sum[:]), Signature: tt.signature}
+			if tt.sha256 != "" {
+				release.SHA256 = tt.sha256
+			}
+
+			err := verify(tt.key, release, binary)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verify = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verify = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOffered(t *testing.T) {
+	tests := []struct {
+		release, current string
+		force            bool
+		install          bool
+		wantErr          bool
+	}{
+		{"1.2.0", "1.1.0", false, true, false},
+		{"v1.10.0", "1.9.3", false, true, false},
+		{"1.1.0", "1.1.0", false, false, false},
+		{"1.1.0", "v1.1.0", false, false, false},
+		{"1.1.0", "1.1.0", true, true, false},
+		{"1.0.9", "1.1.0", false, false, true},
+		{"1.0.9", "1.1.0", true, true, false},
+		{"1.1.0-rc.1", "1.1.0", false, false, true},
+		{"1.1.0", "1.1.0-rc.1", false, true, false},
+		{"1.1.0-rc.2", "1.1.0-rc.1", false, true, false},
+		{"latest", "1.1.0", false, false, true},
+		{"1.2", "1.1.0", false, false, true},
+		{"latest", "1.1.0", true, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s over %s force %v", tt.release, tt.current, tt.force), func(t *testing.T) {
+			install, err := offered(Release{Version: tt.release}, tt.current, tt.force)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("offered = %v, want error %v", err, tt.wantErr)
+			}
+			if install != tt.install {
+				t.Errorf("install = %v, want %v", install, tt.install)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,350 @@
+// Package ws carries envelopes and commands to Momentum over a WebSocket,
+// for sites where the NATS port is blocked but HTTPS is not.
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/auh-xda/magnesia/compression"
+	"github.com/auh-xda/magnesia/config"
+	"github.com/auh-xda/magnesia/console"
+	"github.com/auh-xda/magnesia/identity"
+	"github.com/auh-xda/magnesia/tlsconfig"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	minBackoff   = time.Second
+	maxBackoff   = time.Minute
+	pingInterval = 30 * time.Second
+	pongWait     = 2 * pingInterval
+	writeWait    = 10 * time.Second
+	readLimit    = 8 * 1024 * 1024
+)
+
+// Frame is one message in either direction. It mirrors a NATS message so
+// Momentum can bridge the socket onto its subjects: the agent publishes
+// envelopes with a subject, the server pushes requests with a reply token,
+// and the agent answers by publishing to that token. A compressed message
+// names its algorithm in Encoding and carries Compressed instead of Data.
+type Frame struct {
+	Subject    string          `json:"subject"`
+	Reply      string          `json:"reply,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	Encoding   string          `json:"encoding,omitempty"`
+	Compressed []byte          `json:"compressed,omitempty"`
+}
+
+// Conn is the agent's WebSocket to Momentum. It redials in the background
+// with exponential backoff until Close is called.
+type Conn struct {
+	url string
+	cfg config.Config
+
+	mu     sync.Mutex
+	socket *websocket.Conn
+	closed chan struct{}
+}
+
+var (
+	conn      *Conn
+	connMu    sync.Mutex
+	handlers  = map[string]func(data []byte) []byte{}
+	connected []func(*Conn)
+)
+
+// OnConnect registers fn to run on its own goroutine after every successful
+// dial, e.g. to replay the spool.
+func OnConnect(fn func(*Conn)) {
+	connMu.Lock()
+	defer connMu.Unlock()
+
+	connected = append(connected, fn)
+}
+
+// Connection returns the agent's long-lived WebSocket, starting it on first
+// use. It does not wait for the first dial; check IsConnected before
+// publishing.
+func Connection() (*Conn, error) {
+	connMu.Lock()
+	defer connMu.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	url := cfg.WebSocketURL()
+	if url == "" {
+		return nil, fmt.Errorf("no WebSocket URL configured, set \"websocket\" or \"server\" in config.json")
+	}
+
+	if cfg.TLS.Strict && tlsconfig.Plaintext(url) {
+		return nil, fmt.Errorf("refusing plaintext WebSocket URL %s, tls.strict is set", url)
+	}
+
+	console.Info("Establishing WebSocket connection with " + url)
+
+	conn = &Conn{url: url, cfg: cfg, closed: make(chan struct{})}
+	go conn.run()
+
+	return conn, nil
+}
+
+// Serve answers every request pushed on subject with the reply built by
+// handler. Each request is handled on its own goroutine so a long job does
+// not hold up the next command.
+func Serve(subject string, handler func(data []byte) []byte) error {
+	if _, err := Connection(); err != nil {
+		return err
+	}
+
+	connMu.Lock()
+	handlers[subject] = handler
+	connMu.Unlock()
+
+	console.Success("Listening for commands on " + subject)
+
+	return nil
+}
+
+// Close says goodbye to the server and stops reconnecting.
+func Close() {
+	connMu.Lock()
+	c := conn
+	conn = nil
+	connMu.Unlock()
+
+	if c == nil {
+		return
+	}
+
+	close(c.closed)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.socket == nil {
+		return
+	}
+
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "agent stopping")
+	_ = c.socket.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+	c.socket.Close()
+	c.socket = nil
+}
+
+// IsConnected reports whether the socket is currently up.
+func (c *Conn) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.socket != nil
+}
+
+// Publish sends data, which must be JSON, on subject.
+func (c *Conn) Publish(subject string, data []byte) error {
+	return c.PublishFrame(Frame{Subject: subject, Data: data})
+}
+
+// PublishFrame sends a frame as it is.
+func (c *Conn) PublishFrame(f Frame) error {
+	frame, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.socket == nil {
+		return fmt.Errorf("WebSocket is not connected")
+	}
+
+	c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+
+	return c.socket.WriteMessage(websocket.TextMessage, frame)
+}
+
+// Flush is a no-op: Publish returns once the frame is written.
+func (c *Conn) Flush() error {
+	return nil
+}
+
+func (c *Conn) run() {
+	backoff := minBackoff
+
+	for {
+		socket, err := c.dial()
+		if err != nil {
+			console.Warn(fmt.Sprintf("WebSocket connection failed, retrying in %s: %s", backoff, err.Error()))
+
+			select {
+			case <-c.closed:
+				return
+			case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))):
+			}
+
+			backoff = min(2*backoff, maxBackoff)
+			continue
+		}
+
+		c.mu.Lock()
+		c.socket = socket
+		c.mu.Unlock()
+
+		console.Success("Connected to Momentum at " + c.url)
+
+		connMu.Lock()
+		hooks := append([]func(*Conn){}, connected...)
+		connMu.Unlock()
+
+		for _, fn := range hooks {
+			go fn(c)
+		}
+
+		start := time.Now()
+		err = c.read(socket)
+
+		c.mu.Lock()
+		if c.socket == socket {
+			c.socket = nil
+		}
+		c.mu.Unlock()
+		socket.Close()
+
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+
+		console.Warn("Disconnected from Momentum: " + err.Error())
+
+		// a socket that stayed up earns a fresh backoff; one the server
+		// drops straight away does not
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+	}
+}
+
+// dial opens the socket. The handshake is signed like any other request to
+// Momentum, which is how the server knows which agent is connecting.
+func (c *Conn) dial() (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+
+	if !tlsconfig.Plaintext(c.url) {
+		conf, err := tlsconfig.New(c.cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		dialer.TLSClientConfig = conf
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(identity.SeedPath()); err == nil {
+		if err := identity.SignRequest(req, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	socket, response, err := dialer.Dial(c.url, req.Header)
+	if err != nil {
+		if response != nil {
+			return nil, fmt.Errorf("%v (HTTP %s)", err, response.Status)
+		}
+		return nil, err
+	}
+
+	return socket, nil
+}
+
+// read dispatches pushed frames until the socket fails, pinging the server
+// so a dead connection is noticed even when nothing is being sent.
+func (c *Conn) read(socket *websocket.Conn) error {
+	socket.SetReadLimit(readLimit)
+	socket.SetReadDeadline(time.Now().Add(pongWait))
+	socket.SetPongHandler(func(string) error {
+		return socket.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.mu.Lock()
+				err := socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+				c.mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, message, err := socket.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var frame Frame
+		if err := json.Unmarshal(message, &frame); err != nil {
+			console.Warn("Ignoring malformed WebSocket frame: " + err.Error())
+			continue
+		}
+
+		if frame.Encoding != "" {
+			data, err := compression.Decode(frame.Compressed, frame.Encoding)
+			if err != nil {
+				console.Warn("Ignoring undecodable WebSocket frame: " + err.Error())
+				continue
+			}
+			frame.Data = data
+		}
+
+		connMu.Lock()
+		handler, ok := handlers[frame.Subject]
+		connMu.Unlock()
+
+		if !ok {
+			console.Warn("Ignoring WebSocket frame for unknown subject " + frame.Subject)
+			continue
+		}
+
+		go func() {
+			reply := handler(frame.Data)
+
+			if frame.Reply == "" {
+				return
+			}
+
+			if err := c.Publish(frame.Reply, reply); err != nil {
+				console.Error("Error replying to " + frame.Subject + ": " + err.Error())
+			}
+		}()
+	}
+}